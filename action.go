@@ -0,0 +1,119 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// actions of creating new paths, see --action
+const (
+	actionRename   = "rename"
+	actionCopy     = "copy"
+	actionHardlink = "hardlink"
+	actionSymlink  = "symlink"
+	actionReflink  = "reflink"
+)
+
+var actions = []string{actionRename, actionCopy, actionHardlink, actionSymlink, actionReflink}
+
+// past participles of actions used in messages
+var actionDone = map[string]string{
+	actionRename:   "renamed",
+	actionCopy:     "copied",
+	actionHardlink: "hard-linked",
+	actionSymlink:  "symlinked",
+	actionReflink:  "reflinked",
+}
+
+// createPath creates the target from the source by copying or linking,
+// while the source is kept. The new entry is created with a temporary
+// name next to the target and then renamed, so an existing target is
+// replaced as renaming does, and no partial files are left on failure.
+//
+// Copying keeps permissions, timestamps and extended attributes, and
+// copies of symbolic links are links to the same paths. Symbolic links
+// created by --action symlink point to the source with relative paths.
+func createPath(action string, source string, target string, verifyAlg string, progress bool) error {
+	fi, err := os.Lstat(source)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(target), fmt.Sprintf(".%s.brename-%d", filepath.Base(target), os.Getpid()))
+	switch action {
+	case actionCopy:
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(source); err == nil {
+				err = os.Symlink(link, tmp)
+			}
+		case fi.Mode().IsRegular():
+			if err = copyFile(source, tmp, fi, progress); err == nil {
+				err = verifyCopy(source, tmp, fi, verifyAlg)
+			}
+		default:
+			err = fmt.Errorf("copying %s is not supported", describeMode(fi))
+		}
+	case actionHardlink:
+		err = os.Link(source, tmp)
+	case actionSymlink:
+		err = os.Symlink(symlinkTarget(source, target), tmp)
+	case actionReflink:
+		if !fi.Mode().IsRegular() {
+			err = fmt.Errorf("reflinking %s is not supported", describeMode(fi))
+		} else if err = cloneFile(source, tmp, fi); err == nil {
+			err = copyAttrs(source, tmp, fi)
+		}
+	default:
+		err = fmt.Errorf("unknown action: %s", action)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// symlinkTarget returns the path of the source relative to the directory
+// of the link, or the absolute path if it can not be computed.
+func symlinkTarget(source string, link string) string {
+	src, err := filepath.Abs(source)
+	if err != nil {
+		return source
+	}
+	dir, err := filepath.Abs(filepath.Dir(link))
+	if err != nil {
+		return src
+	}
+	if rel, err := filepath.Rel(dir, src); err == nil {
+		return rel
+	}
+	return src
+}
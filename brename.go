@@ -29,6 +29,8 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -47,8 +49,9 @@ var VERSION = "2.14.1"
 var app = "brename"
 var LastOpDetailFile = ".brename_detail.txt"
 
-// for detecting one case where two or more files are renamed to same new path
-var pathTree map[string]struct{}
+// for detecting one case where two or more files are renamed to same new path.
+// the values are source paths.
+var pathTree map[string]string
 
 // Options is the struct containing all global options
 type Options struct {
@@ -57,9 +60,8 @@ type Options struct {
 	Version bool
 	DryRun  bool
 
-	Pattern      string
-	PatternRe    *regexp.Regexp
-	Replacement  string
+	Rules        []*rule
+	Guards       []*guard
 	Recursive    bool
 	IncludingDir bool
 	OnlyDir      bool
@@ -67,6 +69,11 @@ type Options struct {
 	IgnoreCase   bool
 	IgnoreExt    bool
 	IgnoreErr    bool
+	CompoundExts []string
+	MatchPath    bool
+	Segments     bool
+
+	AllowOutsideRoot bool
 
 	IncludeFilters   []string
 	SkipFilters      []string
@@ -82,7 +89,8 @@ type Options struct {
 
 	ReplaceWithNR bool
 	StartNum      int
-	NRFormat      string
+	NRWidth       int
+	NRCounters    map[string]*nrCounter
 
 	ReplaceWithKV bool
 	KVs           map[string]string
@@ -91,6 +99,56 @@ type Options struct {
 	KeyCaptIdx    int
 	KeyMissRepl   string
 
+	ReplaceWithVideo bool
+	ReplaceWithDoc   bool
+	DocMaxLen        int
+	ReplaceWithImage bool
+	MetaMissRepl     string
+
+	ReplaceWithHash bool
+	HashAlgs        []string
+	Threads         int
+
+	ReplaceWithMimeExt bool
+	FixExt             bool
+	NormalizeExt       bool
+	ExtMap             map[string]string
+
+	DupMode   string
+	DupDir    string
+	DupSuffix string
+
+	SortBy      string
+	SortSeed    int64
+	SortReverse bool
+
+	ReplaceWithStemExt bool
+	ReplaceWithMtime   bool
+	ReplaceWithExif    bool
+
+	Organize string
+
+	Flatten        bool
+	FlattenSep     string
+	FlattenDest    string
+	PruneEmptyDirs bool
+
+	Action     string
+	KeepTimes  bool
+	VerifyCopy string
+
+	Bucket      int
+	BucketWidth int
+	Shard       int
+
+	ReplaceWithRandom bool
+	SeedSet           bool
+	ExportKVFile      string
+
+	FilterImageSize bool
+	ImageMinSize    [2]int
+	ImageMaxSize    [2]int
+
 	OverwriteMode int
 
 	PathCaseInsensitive bool
@@ -103,7 +161,6 @@ type Options struct {
 	ClearOpDetailFiles bool
 }
 
-var reNR = regexp.MustCompile(`\{(NR|nr)\}`)
 var reKV = regexp.MustCompile(`\{(KV|kv)\}`)
 
 func getOptions(cmd *cobra.Command) *Options {
@@ -120,6 +177,7 @@ func getOptions(cmd *cobra.Command) *Options {
 			Undo:             true, // set it true even only force-undo given
 			Quiet:            quiet,
 			ForceUndo:        forceUndo,
+			KeepTimes:        getFlagBool(cmd, "keep-dir-times"),
 			LastOpDetailFile: LastOpDetailFile,
 		}
 	}
@@ -142,20 +200,181 @@ func getOptions(cmd *cobra.Command) *Options {
 		return &Options{Version: version}
 	}
 
-	pattern := getFlagString(cmd, "pattern")
+	patterns := getFlagStringArray(cmd, "pattern")
+	replacements := getFlagStringArray(cmd, "replacement")
+	script := getFlagString(cmd, "script")
+	ignoreExt := getFlagBool(cmd, "ignore-ext")
+	ignoreCase := getFlagBool(cmd, "ignore-case")
+
+	var pattern, replacement string
+	if len(patterns) > 0 {
+		pattern = patterns[0]
+	}
+	if len(replacements) > 0 {
+		replacement = replacements[0]
+	}
+	if script != "" {
+		if len(patterns) > 0 || len(replacements) > 0 {
+			checkError(fmt.Errorf("flag -p/--pattern and -r/--replacement are not allowed when given flag --script"))
+		}
+		pattern = "-" // rules are read from the script file
+	}
+
+	fixExt := getFlagBool(cmd, "fix-ext")
+	normalizeExt := getFlagBool(cmd, "normalize-ext")
+	organize := strings.TrimSpace(getFlagString(cmd, "organize"))
+	flatten := getFlagBool(cmd, "flatten")
+	bucket := getFlagNonNegativeInt(cmd, "bucket")
+	shard := getFlagNonNegativeInt(cmd, "shard")
+
+	// in modes changing paths by themselves, -p/--pattern only selects paths
+	// when -r/--replacement is not given, and the matched text is kept.
+	if fixExt || normalizeExt || organize != "" || flatten || bucket > 0 || shard > 0 {
+		if pattern == "" && len(replacements) > 0 {
+			checkError(fmt.Errorf("flag -p/--pattern needed when given flag -r/--replacement"))
+		}
+		if script == "" && !cmd.Flags().Changed("replacement") {
+			if pattern == "" {
+				pattern = "^.+$"
+			}
+			replacement = "${0}"
+			replacements = make([]string, len(patterns))
+			for i := range replacements {
+				replacements[i] = "${0}"
+			}
+		}
+	}
+
+	toHash := getFlagString(cmd, "to-hash")
+	if toHash != "" {
+		if !reHash.MatchString("{" + toHash + "}") {
+			checkError(fmt.Errorf("invalid value of flag --to-hash: %s, available: md5, sha1, sha256, sha512, with an optional length, e.g., sha256:12", toHash))
+		}
+		if len(replacements) > 0 {
+			checkError(fmt.Errorf("flag -r/--replacement is not allowed when given flag --to-hash"))
+		}
+		if len(patterns) > 1 || script != "" {
+			checkError(fmt.Errorf("only one search pattern is allowed when given flag --to-hash"))
+		}
+		if pattern == "" {
+			pattern = "^.+$"
+		}
+		replacement = "{" + toHash + "}"
+		ignoreExt = true
+	}
+
 	if pattern == "" {
 		log.Errorf(`flag -p/--pattern needed. type "brename -h" for usage and examples.`)
 		os.Exit(1)
 	}
-	p := pattern
-	ignoreCase := getFlagBool(cmd, "ignore-case")
-	if ignoreCase {
-		p = "(?i)" + p
+
+	var rules []*rule
+	var err error
+	if script != "" {
+		rules, err = parseScript(script, ignoreCase)
+		if err != nil {
+			checkError(fmt.Errorf("read script file: %s", err))
+		}
+	} else {
+		if len(patterns) <= 1 { // may be set by --fix-ext or --to-hash
+			patterns, replacements = []string{pattern}, []string{replacement}
+		}
+		if len(replacements) > len(patterns) {
+			checkError(fmt.Errorf("more -r/--replacement (%d) given than -p/--pattern (%d)", len(replacements), len(patterns)))
+		}
+		if len(replacements) > 0 && len(replacements) != len(patterns) {
+			checkError(fmt.Errorf("numbers of -p/--pattern (%d) and -r/--replacement (%d) do not match", len(patterns), len(replacements)))
+		}
+		occurrence, err := cmd.Flags().GetInt("occurrence")
+		checkError(err)
+		maxReplacements := getFlagNonNegativeInt(cmd, "max-replacements")
+
+		rules = make([]*rule, len(patterns))
+		for i, p := range patterns {
+			var r string
+			if len(replacements) > 0 {
+				r = replacements[i]
+			}
+			rules[i], err = newRule(p, r, ignoreCase, occurrence == 0)
+			checkError(err)
+			rules[i].occurrence = occurrence
+			rules[i].limit = maxReplacements
+		}
 	}
-	re, err := regexp.Compile(p)
-	if err != nil {
-		log.Errorf("illegal regular expression for search pattern: %s", pattern)
-		os.Exit(1)
+	if script != "" && (cmd.Flags().Changed("occurrence") || cmd.Flags().Changed("max-replacements")) {
+		checkError(fmt.Errorf("flag --occurrence and --max-replacements are not allowed when given flag --script, please use flags of substitution commands, e.g., s/a/b/2"))
+	}
+
+	guards, ruleGuardMap, err := ruleGuards(orderedFlags, ignoreCase)
+	checkError(err)
+	if script == "" {
+		for i, gs := range ruleGuardMap {
+			if i < len(rules) {
+				rules[i].guards = append(rules[i].guards, gs...)
+			}
+		}
+	}
+
+	// replacements of all rules, for detecting placeholders
+	_replacements := make([]string, 0, len(rules))
+	for _, ru := range rules {
+		for _, b := range append([]*rule{ru}, ru.branches...) {
+			if b.re != nil {
+				_replacements = append(_replacements, b.replacement)
+			}
+		}
+	}
+	if organize != "" {
+		if getFlagBool(cmd, "match-path") || getFlagBool(cmd, "segments") || flatten {
+			checkError(fmt.Errorf("flag --organize is incompatible with -P/--match-path, --segments and --flatten"))
+		}
+		_replacements = append(_replacements, organize)
+	}
+	if flatten && (getFlagBool(cmd, "match-path") || getFlagBool(cmd, "segments") ||
+		getFlagBool(cmd, "including-dir") || getFlagBool(cmd, "only-dir")) {
+		checkError(fmt.Errorf("flag --flatten is incompatible with -P/--match-path, --segments, -D/--including-dir and --only-dir"))
+	}
+	if bucket > 0 || shard > 0 {
+		if bucket > 0 && shard > 0 {
+			checkError(fmt.Errorf("flag --bucket and --shard are incompatible"))
+		}
+		if shard > maxShardLevels {
+			checkError(fmt.Errorf("value of flag --shard should be in range of [1, %d]", maxShardLevels))
+		}
+		if getFlagBool(cmd, "match-path") || getFlagBool(cmd, "segments") ||
+			getFlagBool(cmd, "including-dir") || getFlagBool(cmd, "only-dir") {
+			checkError(fmt.Errorf("flag --bucket and --shard are incompatible with -P/--match-path, --segments, -D/--including-dir and --only-dir"))
+		}
+	}
+	pruneEmptyDirs := getFlagBool(cmd, "prune-empty-dirs")
+
+	action := strings.ToLower(getFlagString(cmd, "action"))
+	if _, ok := actionDone[action]; !ok {
+		checkError(fmt.Errorf("invalid value of flag --action: %s, available: %s", action, strings.Join(actions, ", ")))
+	}
+	if action != actionRename && getFlagBool(cmd, "segments") {
+		checkError(fmt.Errorf("flag --segments only supports --action rename"))
+	}
+	if (action == actionCopy || action == actionHardlink || action == actionReflink) &&
+		(getFlagBool(cmd, "including-dir") || getFlagBool(cmd, "only-dir")) {
+		checkError(fmt.Errorf("flag -D/--including-dir and --only-dir are not supported by --action %s, which only creates files", action))
+	}
+
+	verifyCopy := strings.ToLower(getFlagString(cmd, "verify-copy"))
+	if _, ok := hashFuncs[verifyCopy]; verifyCopy != "" && !ok {
+		checkError(fmt.Errorf("invalid value of flag --verify-copy: %s, available: md5, sha1, sha256, sha512", verifyCopy))
+	}
+	replacement = strings.Join(_replacements, "\n")
+
+	for _, m := range reExif.FindAllStringSubmatch(replacement, -1) {
+		if _, ok := exifTagNames[m[1]]; !ok {
+			names := make([]string, 0, len(exifTagNames))
+			for name := range exifTagNames {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			checkError(fmt.Errorf("unsupported EXIF tag: %s, available: %s", m[0], strings.Join(names, ", ")))
+		}
 	}
 
 	rewildcard := regexp.MustCompile(`^\*`)
@@ -249,7 +468,6 @@ func getOptions(cmd *cobra.Command) *Options {
 		exfilterRes = append(exfilterRes, exfilterRe)
 	}
 
-	replacement := getFlagString(cmd, "replacement")
 	kvFile := getFlagString(cmd, "kv-file")
 
 	if kvFile != "" {
@@ -262,18 +480,34 @@ func getOptions(cmd *cobra.Command) *Options {
 	}
 
 	var replaceWithNR bool
+	var nrCounters map[string]*nrCounter
+	startNum := getFlagNonNegativeInt(cmd, "start-num")
+	nrWidth := getFlagPositiveInt(cmd, "nr-width")
 	if reNR.MatchString(replacement) {
 		replaceWithNR = true
+		nrCounters, err = parseNRCounters(replacement, startNum, nrWidth)
+		checkError(err)
 	}
 
 	var replaceWithKV bool
 	var kvs map[string]string
 	keepKey := getFlagBool(cmd, "keep-key")
 	keyMissRepl := getFlagString(cmd, "key-miss-repl")
+	keyCaptIdx := getFlagPositiveInt(cmd, "key-capt-idx")
 	if reKV.MatchString(replacement) {
 		replaceWithKV = true
-		if !regexp.MustCompile(`\(.+\)`).MatchString(pattern) {
-			checkError(fmt.Errorf(`value of -p/--pattern must contains "(" and ")" to capture data which is used specify the KEY`))
+		for _, _ru := range rules {
+			for _, ru := range _ru.leaves() {
+				if ru.re == nil || !reKV.MatchString(ru.replacement) {
+					continue
+				}
+				if !regexp.MustCompile(`\(.+\)`).MatchString(ru.pattern) {
+					checkError(fmt.Errorf(`value of -p/--pattern must contains "(" and ")" to capture data which is used specify the KEY`))
+				}
+				if keyCaptIdx > ru.re.NumSubexp() {
+					checkError(fmt.Errorf("value of flag -I/--key-capt-idx overflows for search pattern: %s", ru.pattern))
+				}
+			}
 		}
 		if kvFile == "" {
 			checkError(fmt.Errorf(`since replacement symbol "{kv}"/"{KV}" found in value of flag -r/--replacement, tab-delimited key-value file should be given by flag -k/--kv-file`))
@@ -298,6 +532,63 @@ func getOptions(cmd *cobra.Command) *Options {
 		}
 	}
 
+	replaceWithVideo := reVideo.MatchString(replacement)
+	replaceWithDoc := reDoc.MatchString(replacement)
+	replaceWithImage := reImage.MatchString(replacement)
+	hashAlgs := hashAlgorithms(replacement)
+
+	sortBy, sortSeed, err := parseSortBy(getFlagString(cmd, "sort-by"))
+	checkError(err)
+
+	compoundExts := getFlagStringSlice(cmd, "compound-exts")
+	var extMap map[string]string
+	if normalizeExt {
+		extMap, err = loadExtMap(getFlagString(cmd, "ext-map"))
+		if err != nil {
+			checkError(fmt.Errorf("read extension map file: %s", err))
+		}
+		// multi-part synonyms are also matched as a whole
+		for k := range extMap {
+			if strings.Contains(k, ".") {
+				compoundExts = append(compoundExts, k)
+			}
+		}
+	} else if getFlagString(cmd, "ext-map") != "" {
+		checkError(fmt.Errorf("flag --ext-map should be used along with --normalize-ext"))
+	}
+	compoundExts, err = parseCompoundExts(compoundExts)
+	checkError(err)
+
+	replaceWithRandom := reRandom.MatchString(replacement)
+	for _, m := range reRandom.FindAllStringSubmatch(replacement, -1) {
+		if m[2] != "" {
+			if n, _ := strconv.Atoi(m[2]); n <= 0 {
+				checkError(fmt.Errorf("the length in {rand:N} should be positive: %s", m[0]))
+			}
+		}
+	}
+	seedSet := cmd.Flags().Changed("seed")
+	if seedSet {
+		setRandomSeed(int64(getFlagNonNegativeInt(cmd, "seed")))
+	}
+
+	dupMode := getFlagString(cmd, "dup-mode")
+	switch dupMode {
+	case "", "report", "suffix", "skip", "move":
+	default:
+		checkError(fmt.Errorf("invalid value of flag --dup-mode: %s, available: report, suffix, skip, move", dupMode))
+	}
+	dupDir := getFlagString(cmd, "dup-dir")
+	if dupMode == "move" && (dupDir == "" || filepath.IsAbs(dupDir)) {
+		checkError(fmt.Errorf("value of flag --dup-dir should be a relative path"))
+	}
+
+	imageMinSize, err := parseImageSize(getFlagString(cmd, "image-min-size"))
+	checkError(err)
+	imageMaxSize, err := parseImageSize(getFlagString(cmd, "image-max-size"))
+	checkError(err)
+	filterImageSize := imageMinSize != [2]int{} || imageMaxSize != [2]int{}
+
 	verbose := getFlagNonNegativeInt(cmd, "verbose")
 	if verbose > 2 {
 		log.Errorf("illegal value of flag --verbose: %d, only 0/1/2 allowed", verbose)
@@ -355,6 +646,17 @@ func getOptions(cmd *cobra.Command) *Options {
 	recursive := getFlagBool(cmd, "recursive")
 	includingDir := getFlagBool(cmd, "including-dir")
 	onlyDir := getFlagBool(cmd, "only-dir")
+
+	segments := getFlagBool(cmd, "segments")
+	if segments {
+		if getFlagBool(cmd, "match-path") {
+			checkError(fmt.Errorf("flag --segments and -P/--match-path are incompatible"))
+		}
+		recursive, onlyDir = true, true
+	}
+	if flatten {
+		recursive = true
+	}
 	maxDepth := getFlagNonNegativeInt(cmd, "max-depth")
 	onlyList := getFlagBool(cmd, "list")
 
@@ -370,8 +672,17 @@ func getOptions(cmd *cobra.Command) *Options {
 		log.Info()
 
 		log.Info("path filters and search pattern:")
-		log.Infof("   search pattern: %s", p)
-		log.Infof("      replacement: %s", replacement)
+		for i, ru := range rules {
+			if len(rules) > 1 {
+				log.Infof("  rule %d:", i+1)
+			}
+			if ru.re == nil {
+				log.Infof("   conditional rule with %d branches", len(ru.branches))
+				continue
+			}
+			log.Infof("   search pattern: %s", ru.re.String())
+			log.Infof("      replacement: %s", ru.replacement)
+		}
 		log.Infof("      ignore case: %v", ignoreCase)
 		log.Info()
 
@@ -404,16 +715,20 @@ func getOptions(cmd *cobra.Command) *Options {
 		Version: version,
 		DryRun:  dryrun,
 
-		Pattern:      pattern,
-		PatternRe:    re,
-		Replacement:  replacement,
+		Rules:        rules,
+		Guards:       guards,
 		Recursive:    recursive,
 		IncludingDir: includingDir,
 		OnlyDir:      onlyDir,
 		MaxDepth:     maxDepth,
 		IgnoreCase:   ignoreCase,
-		IgnoreExt:    getFlagBool(cmd, "ignore-ext"),
+		IgnoreExt:    ignoreExt,
 		IgnoreErr:    getFlagBool(cmd, "ignore-err"),
+		CompoundExts: compoundExts,
+		MatchPath:    getFlagBool(cmd, "match-path"),
+		Segments:     segments,
+
+		AllowOutsideRoot: getFlagBool(cmd, "allow-outside-root"),
 
 		IncludeFilters:   infilters,
 		IncludeFilterRes: infilterRes,
@@ -428,16 +743,67 @@ func getOptions(cmd *cobra.Command) *Options {
 		NatureSort:  getFlagBool(cmd, "nature-sort"),
 
 		ReplaceWithNR: replaceWithNR,
-		StartNum:      getFlagNonNegativeInt(cmd, "start-num"),
-		NRFormat:      fmt.Sprintf("%%0%dd", getFlagPositiveInt(cmd, "nr-width")),
+		StartNum:      startNum,
+		NRWidth:       nrWidth,
+		NRCounters:    nrCounters,
 		ReplaceWithKV: replaceWithKV,
 
 		KVs:         kvs,
 		KVFile:      kvFile,
 		KeepKey:     keepKey,
-		KeyCaptIdx:  getFlagPositiveInt(cmd, "key-capt-idx"),
+		KeyCaptIdx:  keyCaptIdx,
 		KeyMissRepl: keyMissRepl,
 
+		ReplaceWithVideo: replaceWithVideo,
+		ReplaceWithDoc:   replaceWithDoc,
+		DocMaxLen:        getFlagNonNegativeInt(cmd, "doc-max-len"),
+		ReplaceWithImage: replaceWithImage,
+		MetaMissRepl:     getFlagString(cmd, "meta-miss-repl"),
+
+		ReplaceWithHash: len(hashAlgs) > 0,
+		HashAlgs:        hashAlgs,
+		Threads:         getFlagPositiveInt(cmd, "threads"),
+
+		ReplaceWithMimeExt: reMimeExt.MatchString(replacement),
+		FixExt:             fixExt,
+		NormalizeExt:       normalizeExt,
+		ExtMap:             extMap,
+
+		DupMode:   dupMode,
+		DupDir:    dupDir,
+		DupSuffix: getFlagString(cmd, "dup-suffix"),
+
+		SortBy:      sortBy,
+		SortSeed:    sortSeed,
+		SortReverse: getFlagBool(cmd, "sort-reverse"),
+
+		ReplaceWithStemExt: reStemExt.MatchString(replacement),
+		ReplaceWithMtime:   reMtime.MatchString(replacement),
+		ReplaceWithExif:    reExif.MatchString(replacement),
+
+		Organize: organize,
+
+		Flatten:        flatten,
+		FlattenSep:     getFlagString(cmd, "flatten-sep"),
+		FlattenDest:    getFlagString(cmd, "flatten-dest"),
+		PruneEmptyDirs: pruneEmptyDirs,
+
+		Action:     action,
+		KeepTimes:  getFlagBool(cmd, "keep-dir-times"),
+		VerifyCopy: verifyCopy,
+
+		Bucket:      bucket,
+		BucketWidth: getFlagPositiveInt(cmd, "bucket-width"),
+		Shard:       shard,
+
+		ReplaceWithRandom: replaceWithRandom,
+		SeedSet:           seedSet,
+		ExportKVFile:      getFlagString(cmd, "export-kv"),
+
+		FilterImageSize: filterImageSize,
+		ImageMinSize:    imageMinSize,
+		ImageMaxSize:    imageMaxSize,
+
 		OverwriteMode: overwriteMode,
 
 		PathCaseInsensitive: pathCaseInsensitive,
@@ -465,8 +831,15 @@ func init() {
 	RootCmd.Flags().BoolP("version", "V", false, "print version information and check for update")
 	RootCmd.Flags().BoolP("dry-run", "d", false, "print rename operations but do not run")
 
-	RootCmd.Flags().StringP("pattern", "p", "", "search pattern (regular expression)")
-	RootCmd.Flags().StringP("replacement", "r", "", `replacement. capture variables supported.  e.g. $1 or ${1} (prefered) represents the first submatch. ATTENTION: for *nix OS, use SINGLE quote NOT double quotes or use the \ escape character. Ascending integer is also supported by "{nr}"`)
+	RootCmd.Flags().StringArrayP("pattern", "p", []string{}, `search pattern (regular expression). Multiple -p/-r pairs can be given, which are applied in order to each file name, e.g., -p "\[.*?\]" -r "" -p " +" -r "_"`)
+	RootCmd.Flags().StringArrayP("replacement", "r", []string{}, `replacement. capture variables supported.  e.g. $1 or ${1} (prefered) represents the first submatch. ATTENTION: for *nix OS, use SINGLE quote NOT double quotes or use the \ escape character. Ascending integer is also supported by "{nr}". ATTENTION: since v2.15.0, \L, \U and \E convert the case of the following text (like GNU sed), and are no longer kept as literal text`)
+	RootCmd.Flags().IntP("occurrence", "", 0, `only replace the Nth match in each file name, negative values count from the end, e.g., -1 for the last match. Along with --max-replacements, matches are replaced starting from the Nth one (0 for replacing all matches)`)
+	RootCmd.Flags().IntP("max-replacements", "", 0, `maximum number of matches to replace in each file name (0 for no limit)`)
+	RootCmd.Flags().StringP("script", "", "", `script file of rules applied in order to each file name, one sed-like substitution command per line: s/PATTERN/REPLACEMENT/FLAGS, flags: g for replacing all matches (default: the first one), i for ignoring case`)
+	RootCmd.Flags().StringArrayP("when", "", []string{}, `only apply the rule of the preceding -p/--pattern to paths satisfying the guard: REGEX (matching the file name), path:REGEX (matching the path relative to the search path, with "/" as the separator), or type:NAME[,NAME] (file types like dir, file, symlink, jpg, pdf and fastqgz). Guards given before any -p/--pattern, or along with --script, apply to all rules. Multiple values are combined with AND`)
+	RootCmd.Flags().StringArrayP("unless", "", []string{}, `do not apply the rule of the preceding -p/--pattern to paths satisfying the guard, in the same format and order as --when`)
+	// guards are assigned to rules by the order of these flags
+	recordFlagOrder(RootCmd.Flags(), "pattern", "when", "unless")
 	RootCmd.Flags().BoolP("recursive", "R", false, "rename recursively")
 	RootCmd.Flags().BoolP("including-dir", "D", false, "rename directories")
 	RootCmd.Flags().BoolP("only-dir", "", false, "only rename directories")
@@ -474,23 +847,60 @@ func init() {
 	RootCmd.Flags().BoolP("ignore-case", "i", false, "ignore case of -p/--pattern, -f/--include-filters and -F/--exclude-filters")
 	RootCmd.Flags().BoolP("ignore-ext", "e", false, "ignore file extension. i.e., replacement does not change file extension")
 	RootCmd.Flags().BoolP("ignore-err", "E", false, "ignore director reading errors")
+	RootCmd.Flags().StringP("organize", "", "", `move matched files into directories built from the template, relative to the search path, e.g., "{mtime:2006}/{mtime:01}" and "{exif:Model}/{ext}". All replacement symbols and capture variables of -p/--pattern are supported. File names are kept unless -p/--pattern and -r/--replacement are given. Directories created are removed by undo`)
+	RootCmd.Flags().BoolP("flatten", "", false, `move matched files in all subdirectories (implying -R/--recursive) into the search path, or the directory given by --flatten-dest, with their relative paths joined as new names, e.g., a/b/c.txt -> a_b_c.txt. Without -r/--replacement, -p/--pattern only selects files to move`)
+	RootCmd.Flags().StringP("flatten-sep", "", "_", `separator for joining directories and file names, when using --flatten`)
+	RootCmd.Flags().StringP("flatten-dest", "", "", `destination directory for --flatten, relative to the search path (default: the search path)`)
+	RootCmd.Flags().BoolP("prune-empty-dirs", "", false, `remove directories left empty after moving paths out of them, from the deepest ones, and never the search paths or their parents. Directories removed are recreated by undo`)
+	RootCmd.Flags().StringP("action", "", actionRename, `how to create new paths: rename, copy, hardlink, symlink (relative links to original paths), or reflink (copy-on-write copies on supported file systems, e.g., Btrfs and XFS, Linux only). Original paths are kept for actions other than rename, and new paths are removed by undo. Directories (-D/--including-dir and --only-dir) are only supported by rename and symlink`)
+	RootCmd.Flags().BoolP("keep-dir-times", "", false, `restore access and modification times of directories changed by renaming, including parents of directories created, after renaming or undo`)
+	RootCmd.Flags().StringP("verify-copy", "", "", `files copied by --action copy, or when a new path is on another file system, are verified by sizes. Only files and symbolic links can be moved across file systems, directories are reported as errors in planning. This flag verifies copies further with a hash algorithm: md5, sha1, sha256, sha512`)
+	RootCmd.Flags().IntP("bucket", "", 0, `move matched files into subdirectories 0000/, 0001/, ..., with at most N files in each, in the order of --sort-by. It can be combined with --organize and --flatten. Directories created are removed by undo. Without -r/--replacement, -p/--pattern only selects files to move`)
+	RootCmd.Flags().IntP("bucket-width", "", 4, `width of bucket numbers, when using --bucket`)
+	RootCmd.Flags().IntP("shard", "", 0, `move matched files into N levels of hash-prefix shards, e.g., ab/cd/ for 2, which are two hexadecimal digits of the MD5 digest of the new file name in each level. It can be combined with --organize and --flatten. Directories created are removed by undo. Without -r/--replacement, -p/--pattern only selects files to move`)
+	RootCmd.Flags().BoolP("segments", "", false, `rename matched directory components at any depth under the search paths (implying -R/--recursive and --only-dir), deeper ones first. Renaming is reported for directories along with numbers of descendant paths, rather than listing every path underneath`)
+	RootCmd.Flags().BoolP("match-path", "P", false, `match and replace the path relative to the search path (with "/" as the separator), rather than the file name, so files can be moved across directories`)
+	RootCmd.Flags().BoolP("allow-outside-root", "", false, `allow new paths outside the search paths, e.g., with "../" or symbolic links in replacements. By default, they are reported as errors. For a file given as the search path, its directory is the search path`)
+	RootCmd.Flags().StringSliceP("compound-exts", "", defaultCompoundExts, `multi-part extensions treated as a whole by -e/--ignore-ext and {ext}, matched case-insensitively. Use "" to only treat the last part as the extension`)
 
 	RootCmd.Flags().StringSliceP("include-filters", "f", []string{"."}, `include file filter(s) (regular expression, NOT wildcard). multiple values supported, e.g., -f ".html" -f ".htm", but ATTENTION: each comma in the filter is treated as the separator of multiple filters, please use double quotation marks for patterns containing comma, e.g., -p '"A{2,}"'`)
 	RootCmd.Flags().StringSliceP("skip-filters", "S", []string{`^\.`}, `skip file filter(s) (regular expression, NOT wildcard). multiple values supported, e.g., -S "^\." for skipping files starting with a dot, but ATTENTION: each comma in the filter is treated as the separator of multiple filters, please use double quotation marks for patterns containing comma, e.g., -p '"A{2,}"'`)
 	RootCmd.Flags().StringSliceP("exclude-filters", "F", []string{}, `exclude file filter(s) (regular expression, NOT wildcard). multiple values supported, e.g., -F ".html" -F ".htm", but ATTENTION: each comma in the filter is treated as the separator of multiple filters, please use double quotation marks for patterns containing comma, e.g., -p '"A{2,}"'`)
+	RootCmd.Flags().StringP("image-min-size", "", "", `only rename images (PNG, JPEG, GIF, WebP, TIFF and BMP) with the width and height no less than the given size, in the format of WxH. W or H can be omitted, e.g., "1000x" and "x800"`)
+	RootCmd.Flags().StringP("image-max-size", "", "", `only rename images (PNG, JPEG, GIF, WebP, TIFF and BMP) with the width and height no greater than the given size, in the format of WxH`)
 
 	RootCmd.Flags().BoolP("list", "l", false, `only list paths that match pattern`)
 	RootCmd.Flags().StringP("list-sep", "s", "\n", `separator for list of found paths`)
 	RootCmd.Flags().BoolP("list-abs", "a", false, `list absolute path, using along with -l/--list`)
 	RootCmd.Flags().BoolP("nature-sort", "N", false, `sort paths in nature order for renaming or listing`)
+	RootCmd.Flags().StringP("sort-by", "", "", `order of all matched paths for assigning numbers of {nr}, available: name, natural, mtime, size, exif (EXIF DateTimeOriginal of images, creation time of videos, or modification time for other files, compared in UTC, where EXIF dates without OffsetTimeOriginal are taken as local times), random:SEED. The default is the searching order`)
+	RootCmd.Flags().BoolP("sort-reverse", "", false, `reverse the order for assigning numbers of {nr}`)
 
 	RootCmd.Flags().StringP("kv-file", "k", "",
 		`tab-delimited key-value file for replacing key with value when using "{kv}" in -r (--replacement)`)
 	RootCmd.Flags().BoolP("keep-key", "K", false, "keep the key as value when no value found for the key")
 	RootCmd.Flags().IntP("key-capt-idx", "I", 1, "capture variable index of key (1-based)")
 	RootCmd.Flags().StringP("key-miss-repl", "m", "", "replacement for key with no corresponding value")
-	RootCmd.Flags().IntP("start-num", "n", 1, `starting number when using {nr} in replacement`)
-	RootCmd.Flags().IntP("nr-width", "", 1, `minimum width for {nr} in flag -r/--replacement. e.g., formating "1" to "001" by --nr-width 3`)
+	RootCmd.Flags().IntP("start-num", "n", 1, `starting number when using {nr} in replacement. It can also be set for each {nr}, e.g., {nr:dir,start=0}`)
+	RootCmd.Flags().IntP("nr-width", "", 1, `minimum width for {nr} in flag -r/--replacement. e.g., formating "1" to "001" by --nr-width 3. It can also be set for each {nr}, e.g., {nr:dir,width=3}`)
+
+	RootCmd.Flags().IntP("doc-max-len", "", 100, `maximum length of values of {doc:title} and {doc:author}, longer ones are truncated (0 for no limit). It can also be set for each placeholder, e.g., {doc:title:50}`)
+	RootCmd.Flags().StringP("meta-miss-repl", "", "", `replacement for metadata placeholders (e.g., "{video:created}") with no value, e.g., unsupported file formats or missing fields (default: reporting an error)`)
+
+	RootCmd.Flags().IntP("seed", "", 0, `seed of the random number generator for {uuid}, {ulid} and {rand:N}, for reproducible results. The modification times of files are used as the timestamps of {uuid:v7} and {ulid} when it's given`)
+	RootCmd.Flags().StringP("export-kv", "", "", `export new and original paths of renamed paths into a tab-delimited key-value file, written as each path is renamed. Paths are relative to the search root, so it can be used for renaming them back by: brename -R -P -p "(.+)" -r "{kv}" -k FILE ROOT`)
+
+	RootCmd.Flags().StringP("to-hash", "", "", `rename matched files to their content hashes, keeping file extensions. available algorithms: md5, sha1, sha256, sha512, with an optional length, e.g., sha256:12`)
+	RootCmd.Flags().IntP("threads", "j", runtime.NumCPU(), `number of threads for computing content hashes`)
+
+	RootCmd.Flags().BoolP("fix-ext", "", false, `fix file extensions according to the file types identified by magic bytes, e.g., BGZF and plain gzip are told apart. Mismatched files are reported as "extension mismatch" and renamed. Files of unknown types are not changed. -p/--pattern can be omitted, then all files are checked. Without -r/--replacement, -p/--pattern only selects files to check`)
+
+	RootCmd.Flags().BoolP("normalize-ext", "", false, `lowercase file extensions and replace synonyms with canonical ones, e.g., .JPEG -> .jpg, .tif -> .tiff, .htm -> .html, .fq.gz -> .fastq.gz. -p/--pattern can be omitted, then all files are checked. Without -r/--replacement, -p/--pattern only selects files to check`)
+	RootCmd.Flags().StringP("ext-map", "", "", `tab-delimited file of extension synonyms and canonical extensions for --normalize-ext, e.g., "jfif<tab>jpg", overriding the built-in ones`)
+
+	RootCmd.Flags().StringP("dup-mode", "", "", `detect matched files with identical content, and handle duplicates except the first one in each group. available values: report (only report duplicate groups), suffix (adding a suffix, see --dup-suffix), skip (not renaming them), move (moving them into a directory in the search path, see --dup-dir)`)
+	RootCmd.Flags().StringP("dup-dir", "", "duplicates", `directory in the search path for moving duplicates into, when using "--dup-mode move". Directories of duplicates relative to the search path are kept, e.g., a/b.txt -> duplicates/a/b.txt`)
+	RootCmd.Flags().StringP("dup-suffix", "", "_dup{n}", `suffix added before the extension of duplicates, when using "--dup-mode suffix". {n} is the index of the duplicate in its group`)
 
 	RootCmd.Flags().IntP("overwrite-mode", "o", 0, "overwrite mode (0 for reporting error, 1 for overwrite, 2 for not renaming) (default 0)")
 
@@ -529,6 +939,62 @@ func init() {
       brename --clear -R
   13. also operate on hidden files: empty -S (default: ^\.)
       brename -p xxx -r yyy -S ""
+  14. renaming videos with the creation time and resolution
+      brename -p "^.+$" -r "{video:created}_{video:height}p" -e -f "\.(mp4|mov|mkv|webm)$"
+  15. renaming documents with the metadata
+      brename -p "^.+$" -r "{doc:year} - {doc:title:60}" -e -f "\.(pdf|epub|docx)$"
+  16. adding image resolution to names of images larger than 1000x1000
+      brename -p "^(.+)$" -r "\${1}_{width}x{height}" -e --image-min-size 1000x1000
+  17. renaming files to their content hashes
+      brename --to-hash sha256:12 -R dir
+  18. moving files with identical content into the directory duplicates/
+      brename -p "^.+$" -r '$0' -R --dup-mode move dir
+  19. fixing file extensions according to file content
+      brename --fix-ext -R -d dir
+  20. numbering files in each directory separately
+      brename -p ".+" -r "{nr:dir,width=3}" -e -R dir
+  21. numbering photos by the capture time
+      brename -p ".+" -r "IMG_{nr:width=auto}" -e --sort-by exif dir
+  22. anonymizing sample files, and renaming them back later
+      brename -p ".+" -r "{rand:12}" -e -R --seed 1 --export-kv map.tsv dir
+      brename -R -P -p "(.+)" -r "{kv}" -k map.tsv dir
+  23. reshaping the stem of files like reads_1.fastq.gz, keeping the full extension
+      brename -p "^(\w+)_(\d)$" -r "\${1}.R\${2}" -e dir
+      or brename -p "^(\w+)_(\d)\..+$" -r "\${1}.R\${2}.{ext}" dir
+  24. normalizing file extensions, e.g., .JPEG -> .jpg, .fq.gz -> .fastq.gz
+      brename --normalize-ext -R -d dir
+  25. applying multiple rules in order: removing brackets, replacing spaces, lowercasing
+      brename -p " *\[.*?\]" -r "" -p " +" -r "_" -p ".+" -r '\L$0' dir
+      or write them in a script file, one sed-like command per line:
+          s/ *\[.*?\]//g
+          s/ +/_/g
+          s/.+/\L$0/
+      brename --script rules.txt dir
+  26. conditional rules in a script file, with guards of file names (/REGEX/),
+      relative paths (path:/REGEX/) or file types (type:NAME), negated by "!"
+          if /^IMG_/ then s/IMG_/photo_/ else if /^DSC/ then s/DSC_/camera_/ else s/^/misc_/
+          if type:pdf then s/^/doc_/
+      or only renaming JPEG images not in dir/raw/ by guards
+      brename -p "^" -r "photo_" -R --when type:jpg --unless path:^raw/ dir
+  27. only replacing the last "." or the first two "_"
+      brename -p "\." -r "_" --occurrence -1 -d
+      brename -p "_" -r "-" --max-replacements 2 -d
+  28. restructuring a tree by matching relative paths, e.g., 2023/01/a.jpg -> 2023-01_a.jpg
+      brename -p "^(\d{4})/(\d{2})/(.+)$" -r '${1}-${2}_${3}' -R -P dir
+  29. renaming every directory named 2023 to FY2023 in a tree
+      brename -p "^2023$" -r "FY2023" --segments dir
+  30. organizing photos into directories of years and months, by the capture time
+      brename --organize "{exif:DateTimeOriginal:2006}/{exif:DateTimeOriginal:01}" -f "\.jpe?g$" -i dir
+      or by the modification time, and the camera model
+      brename --organize "{mtime:2006}/{mtime:01}/{exif:Model}" -f "\.jpe?g$" -i dir
+  31. flattening a tree, e.g., a/b/c.txt -> a_b_c.txt, and removing empty directories
+      brename --flatten --prune-empty-dirs dir
+  32. distributing files into subdirectories with at most 1000 files in each,
+      or into two levels of hash-prefix shards
+      brename --bucket 1000 --sort-by name dir
+      brename --shard 2 dir
+  33. creating renamed symbolic links of files, keeping the originals
+      brename -p "(\d+)" -r "sample_\$1" --action symlink -d dir
 
   More examples: https://github.com/shenwei356/brename`
 
@@ -557,7 +1023,7 @@ Additional help topics:{{range .Commands}}{{if .IsAdditionalHelpTopicCommand}}
 Use "{{.CommandPath}} [command] --help" for more information about a command.{{end}}
 `)
 
-	pathTree = make(map[string]struct{}, 1024)
+	pathTree = make(map[string]string, 1024)
 }
 
 func main() {
@@ -608,6 +1074,12 @@ func getFlagString(cmd *cobra.Command, flag string) string {
 	return value
 }
 
+func getFlagStringArray(cmd *cobra.Command, flag string) []string {
+	value, err := cmd.Flags().GetStringArray(flag)
+	checkError(err)
+	return value
+}
+
 func getFlagStringSlice(cmd *cobra.Command, flag string) []string {
 	value, err := cmd.Flags().GetStringSlice(flag)
 	checkError(err)
@@ -692,9 +1164,77 @@ Three path filters:
 
 Special replacement symbols:
 
-  {nr}    Ascending integer
+  {nr}    Ascending integer. Options can be given after a colon, separated by commas:
+            dir          restarting for each directory, e.g., {nr:dir}
+            group=KEY    counting independently for each value of KEY,
+                         e.g., {nr:group=${1}}
+            start=N      starting number (default: value of -n/--start-num)
+            step=N       increment (default: 1)
+            desc         numbering in descending order
+            style=S      decimal (default), hex, HEX, alpha (a, b, ..., z, aa, ...),
+                         ALPHA, roman (i, ii, iii, ...) or ROMAN
+            width=N      minimum width (default: value of --nr-width), or "auto" for the
+                         width of the largest number, computed after all paths are found
+          e.g., {nr:dir,start=0,width=3}, {nr:step=10,width=auto}, {nr:style=ROMAN,desc}
   {kv}    Corresponding value of the key (captured variable $n) by key-value file,
           n can be specified by flag -I/--key-capt-idx (default: 1)
+  {stem}  File name without the extension. Multi-part extensions in --compound-exts,
+          e.g., .tar.gz and .fastq.gz, are treated as a whole
+  {ext}   Extension of the file name, without the leading dot, e.g., fastq.gz
+  \L, \U  Converting the following text to lowercase or uppercase, until \E or the
+          end of the replacement, e.g., -r '\L$0'
+
+  Metadata of video files (MP4/MOV and Matroska/WebM), read from container headers:
+
+  {video:created}          Creation time, in the format of 20060102_150405.
+                           A Go time layout can be given, e.g., {video:created:2006-01-02}
+  {video:duration}         Duration, e.g., 1h2m3s
+  {video:width}            Width of the first video track
+  {video:height}           Height of the first video track
+
+  Metadata of documents (PDF, EPUB and OOXML like docx/xlsx/pptx):
+
+  {doc:title}              Title. The maximum length can be given, e.g., {doc:title:50},
+                           the default value is set by the flag --doc-max-len
+  {doc:author}             Author(s)
+  {doc:year}               Year of creation
+
+  Dimensions of images (PNG, JPEG, GIF, WebP, TIFF and BMP), read from headers only:
+
+  {width}                  Width, with the EXIF orientation applied
+  {height}                 Height, with the EXIF orientation applied
+  {orientation}            landscape, portrait or square
+  {orientation:exif}       EXIF orientation, 1-8
+
+  Content hashes of files, computed in parallel (-j/--threads):
+
+  {md5}, {sha1}, {sha256}, {sha512}
+                           Hex digest. The length can be given, e.g., {sha256:12}.
+                           Files renamed to the same path with identical content
+                           are reported as duplicates, and not renamed
+
+  File type identified by magic bytes (images, archives, compression formats, PDF, media,
+  and bioinformatics formats like BAM and gzipped FASTQ):
+
+  {mimeext}                Extension of the file type, without the leading dot, e.g., fastq.gz
+
+  Modification time and EXIF tags of images:
+
+  {mtime}                  Modification time, in the format of 20060102_150405.
+                           A Go time layout can be given, e.g., {mtime:2006-01-02}
+  {exif:NAME}              EXIF tag, available: Make, Model, Software, Artist, DateTime,
+                           DateTimeOriginal, LensMake and LensModel. A Go time layout
+                           can be given for dates, e.g., {exif:DateTimeOriginal:2006}
+
+  Random and unique IDs, e.g., for anonymizing files (--seed for reproducible results):
+
+  {uuid}, {uuid:v4}        Random UUID (version 4)
+  {uuid:v7}                Time-ordered UUID (version 7)
+  {ulid}                   ULID, 26 characters of Crockford's base32
+  {rand:N}                 Random string of N digits and lowercase letters
+
+  Metadata placeholders with no value are reported as errors, unless the flag
+  --meta-miss-repl is given.
 
 Special cases of replacement string:
  *1. Capture variables should be in the format of '${1}' to reduce errors.
@@ -708,6 +1248,10 @@ Special cases of replacement string:
             -r '{kv}' -k <(sed 's/\$/$$$$/' kv.txt)
     b). If not, use '$$'. e.g., adding '$' to all numbers:
             -p '(\d+)' -d -r '$$${1}'
+  3. '\L' and '\U' convert the following text to lowercase and uppercase,
+     until '\E' or the end, like GNU sed. So these sequences can not be
+     used as literal text in replacements. e.g., capitalizing words:
+            -p '(\w)(\w*)' -r '\U${1}\L${2}'
 
 `, VERSION),
 	Run: func(cmd *cobra.Command, args []string) {
@@ -733,7 +1277,6 @@ Special cases of replacement string:
 
 		// ------------------------------------------------
 		// undo
-		var delimiter = "\t_shenwei356-brename_\t"
 		if opt.Undo {
 			existed, err := pathutil.Exists(opt.LastOpDetailFile)
 			checkError(err)
@@ -744,30 +1287,27 @@ Special cases of replacement string:
 				return
 			}
 
-			history := make([]operation, 0, 1000)
+			history := make([]journalEntry, 0, 1000)
 
 			fn := func(line string) (interface{}, bool, error) {
 				line = strings.TrimRight(line, "\n")
 				if line == "" || line[0] == '#' { // ignoring blank line and comment line
 					return "", false, nil
 				}
-				items := strings.Split(line, delimiter)
-				if len(items) != 2 {
-					return items, false, nil
-				}
-				return operation{source: items[0], target: items[1], code: 0}, true, nil
+				e, ok := parseJournalLine(line)
+				return e, ok, nil
 			}
 
 			var reader *breader.BufferedReader
 			reader, err = breader.NewBufferedReader(opt.LastOpDetailFile, 2, 100, fn)
 			checkError(err)
 
-			var op operation
+			var e journalEntry
 			for chunk := range reader.Ch {
 				checkError(chunk.Err)
 				for _, data := range chunk.Data {
-					op = data.(operation)
-					history = append(history, op)
+					e = data.(journalEntry)
+					history = append(history, e)
 				}
 			}
 			if len(history) == 0 {
@@ -782,12 +1322,23 @@ Special cases of replacement string:
 				log.Infof(bold("Renaming paths back..."))
 				log.Info()
 			}
+			var times *dirTimes
+			if opt.KeepTimes {
+				times = newDirTimes()
+				for _, e := range history {
+					if e.source != "" {
+						times.record(filepath.Dir(e.source))
+					}
+					times.record(filepath.Dir(e.target))
+				}
+			}
+
 			for i := len(history) - 1; i >= 0; i-- {
-				op = history[i]
+				e = history[i]
 
-				err = os.Rename(op.target, op.source)
+				err = e.undo()
 				if err != nil {
-					log.Errorf(`  [%s] %s -> %s: %s`, red("ERROR"), op.source, op.target, err)
+					log.Errorf(`  [%s] %s: %s`, red("ERROR"), e.undoString(), err)
 					if !opt.ForceUndo {
 						if !opt.Quiet {
 							log.Infof("%d path(s) renamed back in %.3f seconds", n, time.Since(timeStart).Seconds())
@@ -797,7 +1348,12 @@ Special cases of replacement string:
 				}
 				n++
 				if !opt.Quiet {
-					log.Infof("  [%s] %s -> %s", green("DONE"), op.target, op.source)
+					log.Infof("  [%s] %s", green("DONE"), e.undoString())
+				}
+			}
+			if times != nil {
+				if err = times.restore(nil); err != nil {
+					log.Warningf("failed to restore times of directories: %s", err)
 				}
 			}
 			if !opt.Quiet {
@@ -866,16 +1422,24 @@ Special cases of replacement string:
 						if verbose {
 							log.Errorf("  %s\n", op)
 						}
-					case codeMissingTarget:
+					case codeMissingTarget, codeMissingMetadata, codeOutsideRoot, codeCrossDevice:
 						log.Errorf("  %s\n", op)
+					case codeDuplicate:
+						if verbose {
+							log.Warningf("  %s (will NOT be renamed)\n", op)
+						}
+					case codeExtMismatch:
+						if verbose {
+							log.Warningf("  %s (fixed by content)\n", op)
+						}
 					}
 				}
 
 				switch op.code {
-				case codeOK:
+				case codeOK, codeExtMismatch:
 					ops = append(ops, op)
 					n++
-				case codeUnchanged:
+				case codeUnchanged, codeDuplicate:
 				case codeExisted, codeOverwriteNewPath:
 					switch opt.OverwriteMode {
 					case 0: // report error
@@ -913,8 +1477,9 @@ Special cases of replacement string:
 			log.Info(bold("Searching for paths to rename..."))
 			log.Info()
 		}
+		candidates := make([]candidate, 0, 1024)
 		for _, path := range paths {
-			err = walk(opt, opCH, path, 1)
+			err = walk(opt, &candidates, path, path, 1)
 			if err != nil {
 				close(opCH)
 				checkError(err)
@@ -923,6 +1488,75 @@ Special cases of replacement string:
 		if !opt.Quiet && !opt.DryRun && !opt.ListPath {
 			fmt.Fprintf(os.Stderr, "\r  %-78s\n", green("Done searching."))
 		}
+		if opt.Segments {
+			candidates = segmentCandidates(candidates, paths)
+		}
+
+		if opt.ReplaceWithHash && !opt.ListPath {
+			files := make([]string, 0, len(candidates))
+			for _, c := range candidates {
+				if matchPath(opt, c.root, c.path) {
+					files = append(files, c.path)
+				}
+			}
+			computeHashes(opt, files, opt.HashAlgs)
+		}
+
+		if opt.DupMode != "" && !opt.ListPath {
+			groups := findDuplicates(opt, candidates)
+			if !opt.Quiet || opt.DryRun {
+				reportDuplicates(groups)
+			}
+		}
+
+		if opt.ReplaceWithNR {
+			countNRTotals(opt, candidates)
+		}
+
+		// numbers of {nr} are assigned in the sorted order,
+		// while paths are still renamed in the searching order.
+		matched := make([]bool, len(candidates))
+		planned := make([]operation, len(candidates))
+		for _, i := range planOrder(opt, candidates) {
+			matched[i], planned[i] = checkOperation(opt, candidates[i].root, candidates[i].path)
+		}
+
+		// parent directories of paths to rename, which might be pruned later
+		pruneRoots := make(map[string]string, 8)
+		if opt.PruneEmptyDirs {
+			for i := range planned {
+				if matched[i] && (planned[i].code == codeOK || planned[i].code == codeExtMismatch) {
+					pruneRoots[filepath.Dir(planned[i].source)] = candidates[i].root
+				}
+			}
+		}
+
+		// search roots of paths to rename, for exporting relative paths
+		var kvRoots map[string]string
+		if opt.ExportKVFile != "" {
+			kvRoots = make(map[string]string, len(planned))
+			for i := range planned {
+				if matched[i] {
+					kvRoots[planned[i].source] = candidates[i].root
+				}
+			}
+		}
+
+		var nDescendants int
+		if opt.Segments && !opt.ListPath {
+			_planned := make([]operation, 0, len(planned))
+			for i, op := range planned {
+				if matched[i] {
+					_planned = append(_planned, op)
+				}
+			}
+			nDescendants = planSegments(_planned)
+		}
+		for i, op := range planned {
+			if matched[i] {
+				opCH <- op
+			}
+		}
 		close(opCH)
 		<-done
 
@@ -937,7 +1571,11 @@ Special cases of replacement string:
 		}
 		if opt.DryRun || (!opt.Quiet && opt.Verbose == 0) || n == 0 {
 			log.Info()
-			log.Infof("%d path(s) to be renamed", n)
+			if opt.Segments {
+				log.Infof("%d directory(s) to be renamed, affecting %d descendant path(s)", n, nDescendants)
+			} else {
+				log.Infof("%d path(s) to be %s", n, actionDone[opt.Action])
+			}
 		}
 		if n == 0 {
 			return
@@ -947,6 +1585,26 @@ Special cases of replacement string:
 			return
 		}
 
+		// times of directories are recorded before creating the undo file,
+		// which might be in one of the directories.
+		var times *dirTimes
+		moved := make(map[string]string, 8)
+		if opt.KeepTimes {
+			times = newDirTimes()
+			for _, op := range ops {
+				times.record(filepath.Dir(op.source))
+				times.record(filepath.Dir(op.target))
+				if opt.Action == actionRename {
+					if fi, err := os.Lstat(op.source); err == nil && fi.IsDir() {
+						moved[op.source] = op.target
+					}
+				}
+			}
+			for dir, root := range pruneRoots {
+				times.recordUpTo(dir, root)
+			}
+		}
+
 		var fh *os.File
 		var bfh *bufio.Writer
 		if !opt.DisableUndo {
@@ -959,12 +1617,25 @@ Special cases of replacement string:
 			}()
 		}
 
+		// new and original paths are written once renamed, without
+		// buffering, so they are kept even if renaming stops by errors.
+		var kvfh *os.File
+		if opt.ExportKVFile != "" {
+			kvfh, err = os.Create(opt.ExportKVFile)
+			checkError(err)
+			defer kvfh.Close()
+		}
+
 		var n2 int
 		var targetDir string
 		var targetDirExisted bool
 		if !opt.Quiet {
 			log.Info()
-			log.Info(bold("Renaming paths..."))
+			if opt.Action == actionRename {
+				log.Info(bold("Renaming paths..."))
+			} else {
+				log.Info(bold("Creating new paths..."))
+			}
 			log.Info()
 		}
 		for _, op := range ops {
@@ -975,26 +1646,73 @@ Special cases of replacement string:
 				os.Exit(1)
 			}
 			if !targetDirExisted {
-				os.MkdirAll(targetDir, 0755)
+				dirs, err := makeDirs(targetDir)
+				if !opt.DisableUndo {
+					for _, dir := range dirs {
+						bfh.WriteString(journalEntry{journalMkdir, "", dir}.String() + "\n")
+					}
+				}
+				if err != nil {
+					log.Errorf(`  [%s] %s -> %s: %s`, red("ERROR"), op.source, op.target, err)
+					os.Exit(1)
+				}
 			}
 
-			err = os.Rename(op.source, op.target)
+			kind := journalRename
+			if opt.Action == actionRename {
+				err = os.Rename(op.source, op.target)
+				if err != nil && isCrossDevice(err) {
+					// falling back to copying and deleting across file systems
+					kind = journalMove
+					err = moveAcrossDevices(op.source, op.target, opt.VerifyCopy, !opt.Quiet)
+				}
+			} else {
+				kind = journalCreate
+				err = createPath(opt.Action, op.source, op.target, opt.VerifyCopy, !opt.Quiet)
+			}
 			if err != nil {
 				log.Errorf(`  [%s] %s -> %s: %s`, red("ERROR"), op.source, op.target, err)
 				os.Exit(1)
 			}
 			if !opt.Quiet {
-				log.Infof("  [%s] %s -> %s", green("DONE"), op.source, op.target)
+				if kind == journalMove {
+					log.Infof("  [%s] %s -> %s (moved across file systems)", green("DONE"), op.source, op.target)
+				} else {
+					log.Infof("  [%s] %s -> %s", green("DONE"), op.source, op.target)
+				}
 			}
 			if !opt.DisableUndo {
-				bfh.WriteString(fmt.Sprintf("%s%s%s\n", op.source, delimiter, op.target))
+				bfh.WriteString(journalEntry{kind, op.source, op.target}.String() + "\n")
+			}
+			if kvfh != nil {
+				checkError(exportKV(kvfh, kvRoots[op.source], op))
 			}
 			n2++
 		}
 
+		if opt.PruneEmptyDirs {
+			for _, dir := range pruneEmptyDirs(pruneRoots) {
+				if !opt.Quiet {
+					log.Infof("  [%s] removed empty directory %s", green("DONE"), dir)
+				}
+				if !opt.DisableUndo {
+					bfh.WriteString(journalEntry{journalRmdir, "", dir}.String() + "\n")
+				}
+			}
+		}
+
+		if times != nil {
+			if err = times.restore(moved); err != nil {
+				log.Warningf("failed to restore times of directories: %s", err)
+			}
+		}
+
 		if !opt.Quiet {
 			log.Info()
-			log.Infof("%d path(s) renamed in %.3f seconds", n2, time.Since(timeStart).Seconds())
+			log.Infof("%d path(s) %s in %.3f seconds", n2, actionDone[opt.Action], time.Since(timeStart).Seconds())
+			if opt.ExportKVFile != "" {
+				log.Infof("new and original paths saved to %s", opt.ExportKVFile)
+			}
 		}
 	},
 }
@@ -1009,6 +1727,11 @@ const (
 	codeMissingTarget
 	codeEndingWithSpace
 	codeEndingWithPeriod
+	codeMissingMetadata
+	codeDuplicate
+	codeOutsideRoot
+	codeCrossDevice
+	codeExtMismatch // renamed like codeOK, with the extension fixed
 )
 
 var yellow = color.New(color.FgYellow).SprintFunc()
@@ -1032,6 +1755,16 @@ func (c code) String() string {
 		return red("new path ending with a space")
 	case codeEndingWithPeriod:
 		return red("new path ending with a period")
+	case codeMissingMetadata:
+		return red("missing metadata")
+	case codeDuplicate:
+		return yellow("duplicate content")
+	case codeOutsideRoot:
+		return red("new path outside the search root")
+	case codeCrossDevice:
+		return red("moving directory or special file across file systems")
+	case codeExtMismatch:
+		return yellow("extension mismatch")
 	}
 
 	return "undefined code"
@@ -1044,60 +1777,146 @@ type operation struct {
 }
 
 func (op operation) String() string {
+	if n, ok := segmentDescendants[op.source]; ok {
+		return fmt.Sprintf(`[%s] %s -> %s (%d descendant paths)`, op.code, op.source, op.target, n)
+	}
 	return fmt.Sprintf(`[%s] %s -> %s`, op.code, op.source, op.target)
 }
 
-// checkOperation checks an renaming operation
-func checkOperation(opt *Options, path string) (bool, operation) {
-	dir, filename := filepath.Split(path)
-	var ext string
+// candidate is a path found in a search path
+type candidate struct {
+	path string
+	root string // the search path, or its parent directory if it's a file
+}
+
+// splitPath splits a path into the directory, the file name to match,
+// and the extension which is not touched when -e/--ignore-ext given.
+// In the mode of --match-path, the name to match is the path relative to
+// the search root, with "/" as the separator.
+func splitPath(opt *Options, root string, path string) (dir, filename, ext string) {
+	dir, filename = filepath.Split(path)
+	if opt.MatchPath {
+		if rel, err := filepath.Rel(root, path); err == nil && rel != "." {
+			dir, filename = root, filepath.ToSlash(rel)
+		}
+	}
 	if opt.IgnoreExt {
-		ext = filepath.Ext(path)
+		_, ext = splitExt(opt, filepath.Base(path))
 		filename = filename[0 : len(filename)-len(ext)]
 	}
+	return
+}
 
-	if !opt.PatternRe.MatchString(filename) {
+// matchPath checks if the name of a path matches any rule
+func matchPath(opt *Options, root string, path string) bool {
+	_, filename, _ := splitPath(opt, root, path)
+	return matchedRule(opt, root, path, filename) != nil
+}
+
+// checkOperation checks an renaming operation
+func checkOperation(opt *Options, root string, path string) (bool, operation) {
+	dir, filename, ext := splitPath(opt, root, path)
+
+	if matchedRule(opt, root, path, filename) == nil {
 		return false, operation{}
 	}
 
-	r := opt.Replacement
-
+	// numbers are assigned once for each path, and shared by all rules
+	var nrValues map[string]string
 	if opt.ReplaceWithNR {
-		r = reNR.ReplaceAllString(r, fmt.Sprintf(opt.NRFormat, opt.StartNum))
-		opt.StartNum++
+		nrValues = nextNRValues(opt, root, path, filename)
 	}
 
-	if opt.ReplaceWithKV {
-		founds := opt.PatternRe.FindAllStringSubmatch(filename, -1)
-		if len(founds) > 0 {
-			found := founds[0]
-			if opt.KeyCaptIdx > len(found)-1 {
-				checkError(fmt.Errorf("value of flag -I/--key-capt-idx overflows"))
-			}
-			k := found[opt.KeyCaptIdx]
-			if opt.IgnoreCase {
-				k = strings.ToLower(k)
-			}
-			if _, ok := opt.KVs[k]; ok {
-				r = reKV.ReplaceAllString(r, opt.KVs[k])
-			} else if opt.KeepKey {
-				r = reKV.ReplaceAllString(r, found[opt.KeyCaptIdx])
-			} else if opt.KeyMissRepl != "" {
-				r = reKV.ReplaceAllString(r, opt.KeyMissRepl)
-			} else {
-				return false, operation{path, path, codeUnchanged}
+	name := filename
+	for _, ru := range opt.Rules {
+		if ru = ru.resolve(opt, root, path, name); ru == nil {
+			continue
+		}
+		r, c := fillReplacement(opt, ru, path, name, nrValues)
+		switch c {
+		case codeOK:
+		case codeUnchanged:
+			return false, operation{path, path, c}
+		default:
+			return true, operation{path, path, c}
+		}
+		name = ru.replace(name, r)
+	}
+
+	filename2 := name + ext
+
+	// paths with extensions fixed are renamed, but reported separately
+	codeRenamed := codeOK
+	if opt.FixExt {
+		if t := sniffFileType(path); t != nil {
+			if fixed := fixExt(filename2, t); fixed != filename2 {
+				filename2 = fixed
+				codeRenamed = codeExtMismatch
 			}
 		}
 	}
 
-	filename2 := opt.PatternRe.ReplaceAllString(filename, r) + ext
+	if opt.NormalizeExt {
+		filename2 = normalizeExt(opt, filename2)
+	}
 
-	target := filepath.Join(dir, filename2)
+	if opt.Organize != "" {
+		sub, c := organizeDir(opt, root, path, filename, nrValues)
+		switch c {
+		case codeOK:
+		case codeUnchanged:
+			return false, operation{path, path, c}
+		default:
+			return true, operation{path, path, c}
+		}
+		dir = filepath.Join(root, sub)
+	}
+
+	if opt.Flatten {
+		dest := flattenDir(opt, root)
+		filename2 = flattenName(opt, root, path, dest, filename2)
+		dir = dest
+	}
+
+	if opt.Bucket > 0 {
+		dir = filepath.Join(dir, bucketDir(opt, dir))
+	} else if opt.Shard > 0 {
+		dir = filepath.Join(dir, shardDir(opt, filename2))
+	}
+
+	if opt.DupMode != "" {
+		if idx, ok := duplicates[path]; ok && idx > 0 {
+			switch opt.DupMode {
+			case "skip":
+				return true, operation{path, path, codeDuplicate}
+			case "suffix":
+				stem, e := splitExt(opt, filename2)
+				filename2 = stem + strings.ReplaceAll(opt.DupSuffix, "{n}", strconv.Itoa(idx)) + e
+			case "move":
+				// keeping relative directories, so duplicates with the same
+				// name from different directories do not collide.
+				dir = filepath.Join(root, opt.DupDir)
+				if rel, err := filepath.Rel(root, filepath.Dir(path)); err == nil && rel != "." {
+					dir = filepath.Join(dir, rel)
+				}
+			}
+		}
+	}
+
+	target := filepath.Join(dir, filepath.FromSlash(filename2))
 
 	if filename2 == "" {
 		return true, operation{path, target, codeMissingTarget}
 	}
 
+	if target == filepath.Clean(path) {
+		return true, operation{path, target, codeUnchanged}
+	}
+
+	if !opt.AllowOutsideRoot && !confined(root, target) {
+		return true, operation{path, target, codeOutsideRoot}
+	}
+
 	if filename2[len(filename2)-1] == '.' {
 		return true, operation{path, target, codeEndingWithPeriod}
 	}
@@ -1106,19 +1925,25 @@ func checkOperation(opt *Options, path string) (bool, operation) {
 		return true, operation{path, target, codeEndingWithSpace}
 	}
 
-	if filename2 == filename+ext {
-		return true, operation{path, target, codeUnchanged}
+	if opt.Action == actionRename && !movableAcrossDevices(path, target) {
+		return true, operation{path, target, codeCrossDevice}
 	}
 
 	if runtime.GOOS == "windows" {
 		if _, err := os.Stat(target); err == nil {
 			if strings.EqualFold(target, path) { //  rename
 			} else { // overwrite existed file
+				if opt.ReplaceWithHash && sameContent(path, target, opt.HashAlgs[0]) {
+					return true, operation{path, target, codeDuplicate}
+				}
 				return true, operation{path, target, codeExisted}
 			}
 		}
 	} else {
 		if _, err := os.Stat(target); err == nil {
+			if opt.ReplaceWithHash && sameContent(path, target, opt.HashAlgs[0]) {
+				return true, operation{path, target, codeDuplicate}
+			}
 			return true, operation{path, target, codeExisted}
 		}
 	}
@@ -1127,12 +1952,192 @@ func checkOperation(opt *Options, path string) (bool, operation) {
 	if opt.PathCaseInsensitive {
 		target2 = strings.ToLower(target)
 	}
-	if _, ok := pathTree[target2]; ok {
+	if source, ok := pathTree[target2]; ok {
+		if opt.ReplaceWithHash && sameContent(path, source, opt.HashAlgs[0]) {
+			return true, operation{path, target, codeDuplicate}
+		}
 		return true, operation{path, target, codeOverwriteNewPath}
 	}
-	pathTree[target2] = struct{}{}
+	pathTree[target2] = path
 
-	return true, operation{path, target, codeOK}
+	return true, operation{path, target, codeRenamed}
+}
+
+// fillReplacement fills placeholders in the replacement of a rule for a path,
+// name is the current file name the rule is applied to. A code other than
+// codeOK is returned if the path should not be renamed.
+func fillReplacement(opt *Options, ru *rule, path string, name string, nrValues map[string]string) (string, code) {
+	r := ru.replacement
+
+	if opt.ReplaceWithNR {
+		r = replaceNRPlaceholders(r, nrValues)
+	}
+
+	if opt.ReplaceWithKV && reKV.MatchString(r) {
+		founds := ru.re.FindAllStringSubmatch(name, -1)
+		if len(founds) > 0 {
+			found := founds[0]
+			k := found[opt.KeyCaptIdx]
+			if opt.IgnoreCase {
+				k = strings.ToLower(k)
+			}
+			if _, ok := opt.KVs[k]; ok {
+				r = reKV.ReplaceAllString(r, opt.KVs[k])
+			} else if opt.KeepKey {
+				r = reKV.ReplaceAllString(r, found[opt.KeyCaptIdx])
+			} else if opt.KeyMissRepl != "" {
+				r = reKV.ReplaceAllString(r, opt.KeyMissRepl)
+			} else {
+				return r, codeUnchanged
+			}
+		}
+	}
+
+	if opt.ReplaceWithVideo {
+		var ok bool
+		if r, ok = replaceVideoPlaceholders(opt, path, r); !ok {
+			return r, codeMissingMetadata
+		}
+	}
+
+	if opt.ReplaceWithDoc {
+		var ok bool
+		if r, ok = replaceDocPlaceholders(opt, path, r); !ok {
+			return r, codeMissingMetadata
+		}
+	}
+
+	if opt.ReplaceWithImage {
+		var ok bool
+		if r, ok = replaceImagePlaceholders(opt, path, r); !ok {
+			return r, codeMissingMetadata
+		}
+	}
+
+	if opt.ReplaceWithMimeExt {
+		var ok bool
+		if r, ok = replaceMimeExtPlaceholders(opt, path, r); !ok {
+			return r, codeMissingMetadata
+		}
+	}
+
+	if opt.ReplaceWithHash {
+		var ok bool
+		if r, ok = replaceHashPlaceholders(opt, path, r); !ok {
+			return r, codeMissingMetadata
+		}
+	}
+
+	if opt.ReplaceWithRandom {
+		r = replaceRandomPlaceholders(opt, path, r)
+	}
+
+	if opt.ReplaceWithStemExt {
+		r = replaceStemExtPlaceholders(opt, path, r)
+	}
+
+	if opt.ReplaceWithMtime {
+		var ok bool
+		if r, ok = replaceMtimePlaceholders(opt, path, r); !ok {
+			return r, codeMissingMetadata
+		}
+	}
+
+	if opt.ReplaceWithExif {
+		var ok bool
+		if r, ok = replaceExifPlaceholders(opt, path, r); !ok {
+			return r, codeMissingMetadata
+		}
+	}
+
+	return r, codeOK
+}
+
+// insideRoot checks if a path is inside the root directory lexically
+func insideRoot(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolved search roots
+var resolvedRoots = make(map[string]string, 8)
+
+// confined checks if a new path stays inside the search root, after
+// resolving symbolic links in the root and existing parents of the path.
+// The path itself is not resolved, as it's where the renamed entry lands,
+// not where a symbolic link points to.
+func confined(root string, path string) bool {
+	_root, ok := resolvedRoots[root]
+	if !ok {
+		_root = resolvePath(root)
+		resolvedRoots[root] = _root
+	}
+	path = filepath.Clean(path)
+	return insideRoot(_root, filepath.Join(resolvePath(filepath.Dir(path)), filepath.Base(path)))
+}
+
+// resolvePath returns the absolute path with symbolic links in the longest
+// existing prefix resolved, the path itself may not exist.
+func resolvePath(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	rest := ""
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _path, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(_path, rest)
+		}
+		if dir == filepath.Dir(dir) {
+			return path
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// escapeReplacement escapes "$" in values filled into the replacement,
+// so they are not treated as capture variables.
+func escapeReplacement(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// replaceMetadata fills metadata placeholders matched by re in the replacement,
+// with values returned by fn. It returns false if any value is not available
+// and no replacement for missing metadata is given.
+func replaceMetadata(opt *Options, re *regexp.Regexp, r string, fn func(m []string) (string, bool)) (string, bool) {
+	ok := true
+	r = re.ReplaceAllStringFunc(r, func(s string) string {
+		v, found := fn(re.FindStringSubmatch(s))
+		if !found {
+			if opt.MetaMissRepl == "" {
+				ok = false
+				return s
+			}
+			return escapeReplacement(opt.MetaMissRepl)
+		}
+		return escapeReplacement(sanitizeValue(v))
+	})
+	return r, ok
+}
+
+// sanitizeValue makes a metadata value safe to be part of a file name
+func sanitizeValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '-'
+		case r < 32 || r == 127:
+			return ' '
+		}
+		if runtime.GOOS == "windows" && strings.ContainsRune(`:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.TrimRight(strings.TrimSpace(s), ". ")
 }
 
 // ignore checks if we should ignore this path
@@ -1238,8 +2243,9 @@ func clear(opt *Options, path string, depth int) error {
 	return nil
 }
 
-// walk recursively search file to rename
-func walk(opt *Options, opCh chan<- operation, path string, depth int) error {
+// walk recursively searches paths to rename, the paths are appended to
+// candidates in the order of renaming.
+func walk(opt *Options, candidates *[]candidate, root string, path string, depth int) error {
 	if opt.MaxDepth > 0 && depth > opt.MaxDepth {
 		return nil
 	}
@@ -1258,9 +2264,13 @@ func walk(opt *Options, opCh chan<- operation, path string, depth int) error {
 		if ignore(opt, filepath.Base(path)) {
 			return nil
 		}
-		if ok, op := checkOperation(opt, path); ok {
-			opCh <- op
+		if opt.FilterImageSize && filterImageSize(opt, path) {
+			return nil
+		}
+		if depth == 1 {
+			root = filepath.Dir(path)
 		}
+		*candidates = append(*candidates, candidate{path, root})
 		return nil
 	}
 
@@ -1303,9 +2313,10 @@ func walk(opt *Options, opCh chan<- operation, path string, depth int) error {
 				continue
 			}
 			fileFullPath := filepath.Join(path, filename)
-			if ok, op := checkOperation(opt, fileFullPath); ok {
-				opCh <- op
+			if opt.FilterImageSize && filterImageSize(opt, fileFullPath) {
+				continue
 			}
+			*candidates = append(*candidates, candidate{fileFullPath, root})
 		}
 	}
 
@@ -1320,16 +2331,14 @@ func walk(opt *Options, opCh chan<- operation, path string, depth int) error {
 
 		fileFullPath := filepath.Join(path, filename)
 		if opt.Recursive {
-			err := walk(opt, opCh, fileFullPath, depth+1)
+			err := walk(opt, candidates, root, fileFullPath, depth+1)
 			if err != nil {
 				return err
 			}
 		}
 		// rename directories
 		if (opt.OnlyDir || opt.IncludingDir) && !ignore(opt, filename) {
-			if ok, op := checkOperation(opt, fileFullPath); ok {
-				opCh <- op
-			}
+			*candidates = append(*candidates, candidate{fileFullPath, root})
 		}
 	}
 
@@ -1339,9 +2348,7 @@ func walk(opt *Options, opCh chan<- operation, path string, depth int) error {
 
 	// rename the given root directory
 	if (opt.OnlyDir || opt.IncludingDir) && !ignore(opt, path) {
-		if ok, op := checkOperation(opt, path); ok {
-			opCh <- op
-		}
+		*candidates = append(*candidates, candidate{path, filepath.Dir(path)})
 	}
 
 	return nil
@@ -0,0 +1,56 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+)
+
+// maximum levels of hash-prefix shards, limited by the length of MD5 digests
+const maxShardLevels = 16
+
+// numbers of files assigned to buckets in each directory
+var bucketCounters = make(map[string]int, 8)
+
+// bucketDir returns the name of the bucket for the next file in a
+// directory. Files are assigned in the order of planning, which is
+// controlled by --sort-by, so the same input always gives the same buckets.
+func bucketDir(opt *Options, dir string) string {
+	dir = filepath.Clean(dir)
+	i := bucketCounters[dir]
+	bucketCounters[dir]++
+	return fmt.Sprintf("%0*d", opt.BucketWidth, i/opt.Bucket)
+}
+
+// shardDir returns the hash-prefix shard of a file name, i.e., levels of
+// two hexadecimal digits from the MD5 digest of the name, e.g., ab/cd.
+func shardDir(opt *Options, name string) string {
+	sum := md5.Sum([]byte(name))
+	digest := hex.EncodeToString(sum[:])
+	parts := make([]string, opt.Shard)
+	for i := range parts {
+		parts[i] = digest[i*2 : i*2+2]
+	}
+	return filepath.Join(parts...)
+}
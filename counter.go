@@ -0,0 +1,296 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// {nr} with optional options, e.g., {nr:dir,start=0,width=3} and {nr:group=${1}}
+var reNR = regexp.MustCompile(`\{(?:NR|nr)(?::((?:[^{}]|\$\{\w+\})*))?\}`)
+
+// scopes of {nr} counters
+const (
+	nrScopeGlobal = iota // one counter for all paths
+	nrScopeDir           // one counter for each directory
+	nrScopeGroup         // one counter for each value of the group key
+)
+
+// numbering styles of {nr}
+const (
+	nrStyleDecimal = iota
+	nrStyleHex
+	nrStyleHEX
+	nrStyleAlpha // a, b, ..., z, aa, ab, ...
+	nrStyleALPHA
+	nrStyleRoman // i, ii, iii, iv, ...
+	nrStyleROMAN
+)
+
+var nrStyles = map[string]int{
+	"decimal": nrStyleDecimal,
+	"hex":     nrStyleHex,
+	"HEX":     nrStyleHEX,
+	"alpha":   nrStyleAlpha,
+	"ALPHA":   nrStyleALPHA,
+	"roman":   nrStyleRoman,
+	"ROMAN":   nrStyleROMAN,
+}
+
+// nrCounter generates integers for a {nr} placeholder
+type nrCounter struct {
+	scope int
+	key   string // template of the group key, e.g., $1
+
+	start     int
+	step      int
+	desc      bool
+	style     int
+	width     int
+	autoWidth bool
+
+	counts map[string]int // scope key -> number of paths counted
+	totals map[string]int // scope key -> number of paths in the scope
+}
+
+// needTotals tells if totals of paths in scopes are needed before numbering
+func (c *nrCounter) needTotals() bool {
+	return c.desc || c.autoWidth
+}
+
+// parseNRCounter parses options of a {nr} placeholder, separated by commas:
+//
+//	dir        restarting for each directory
+//	group=KEY  counting independently for each value of KEY, e.g., $1
+//	start=N    starting number
+//	step=N     increment
+//	desc       numbering in descending order
+//	style=S    decimal, hex, HEX, alpha, ALPHA, roman or ROMAN
+//	width=N    minimum width, or "auto" for the width of the largest number
+func parseNRCounter(spec string, start int, width int) (*nrCounter, error) {
+	c := &nrCounter{
+		scope:  nrScopeGlobal,
+		start:  start,
+		step:   1,
+		style:  nrStyleDecimal,
+		width:  width,
+		counts: make(map[string]int, 8),
+		totals: make(map[string]int, 8),
+	}
+	if spec == "" {
+		return c, nil
+	}
+
+	var err error
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		name, value := item, ""
+		if i := strings.IndexByte(item, '='); i >= 0 {
+			name, value = item[:i], item[i+1:]
+		}
+		switch name {
+		case "dir":
+			c.scope = nrScopeDir
+		case "group":
+			if value == "" {
+				return nil, fmt.Errorf("key missing for {nr:group=KEY}, e.g., {nr:group=$1}")
+			}
+			c.scope = nrScopeGroup
+			c.key = value
+		case "start":
+			if c.start, err = strconv.Atoi(value); err != nil {
+				return nil, fmt.Errorf("invalid value of start in {nr}: %s", value)
+			}
+		case "step":
+			if c.step, err = strconv.Atoi(value); err != nil || c.step <= 0 {
+				return nil, fmt.Errorf("invalid value of step in {nr}: %s, a positive integer needed", value)
+			}
+		case "desc":
+			c.desc = true
+		case "style":
+			var ok bool
+			if c.style, ok = nrStyles[value]; !ok {
+				return nil, fmt.Errorf("invalid value of style in {nr}: %s, available: decimal, hex, HEX, alpha, ALPHA, roman, ROMAN", value)
+			}
+		case "width":
+			if value == "auto" {
+				c.autoWidth = true
+				break
+			}
+			if c.width, err = strconv.Atoi(value); err != nil || c.width <= 0 {
+				return nil, fmt.Errorf("invalid value of width in {nr}: %s", value)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option of {nr}: %s", item)
+		}
+	}
+
+	if c.start < 1 && c.style >= nrStyleAlpha {
+		return nil, fmt.Errorf("the starting number of {nr} should be positive for alphabetic and Roman numerals")
+	}
+	if c.start < 0 {
+		return nil, fmt.Errorf("the starting number of {nr} should not be negative")
+	}
+	return c, nil
+}
+
+// parseNRCounters creates counters for all {nr} placeholders in the replacement.
+// Identical placeholders share the same counter.
+func parseNRCounters(r string, start int, width int) (map[string]*nrCounter, error) {
+	counters := make(map[string]*nrCounter, 1)
+	for _, m := range reNR.FindAllStringSubmatch(r, -1) {
+		if _, ok := counters[m[0]]; ok {
+			continue
+		}
+		c, err := parseNRCounter(m[1], start, width)
+		if err != nil {
+			return nil, err
+		}
+		counters[m[0]] = c
+	}
+	return counters, nil
+}
+
+// scopeKey returns the key of the scope the path belongs to.
+// Group keys are captured by the first rule matching the file name.
+func (c *nrCounter) scopeKey(opt *Options, root string, path string, filename string) string {
+	switch c.scope {
+	case nrScopeDir:
+		return filepath.Dir(path)
+	case nrScopeGroup:
+		ru := matchedRule(opt, root, path, filename)
+		if ru == nil {
+			return ""
+		}
+		loc := ru.re.FindStringSubmatchIndex(filename)
+		return string(ru.re.ExpandString(nil, c.key, filename, loc))
+	}
+	return ""
+}
+
+// next returns the next number in the scope
+func (c *nrCounter) next(key string) string {
+	i := c.counts[key]
+	c.counts[key]++
+	if c.desc {
+		i = c.totals[key] - 1 - i
+	}
+
+	width := c.width
+	if c.autoWidth {
+		width = len(c.format(c.start+(c.totals[key]-1)*c.step, 0))
+	}
+	return c.format(c.start+i*c.step, width)
+}
+
+// format formats a number in the style. Zeros are padded for decimal
+// and hexadecimal numbers.
+func (c *nrCounter) format(n int, width int) string {
+	switch c.style {
+	case nrStyleHex:
+		return fmt.Sprintf("%0*x", width, n)
+	case nrStyleHEX:
+		return fmt.Sprintf("%0*X", width, n)
+	case nrStyleAlpha:
+		return alphaNumeral(n, 'a')
+	case nrStyleALPHA:
+		return alphaNumeral(n, 'A')
+	case nrStyleRoman:
+		return strings.ToLower(romanNumeral(n))
+	case nrStyleROMAN:
+		return romanNumeral(n)
+	}
+	return fmt.Sprintf("%0*d", width, n)
+}
+
+// alphaNumeral converts a positive integer to a bijective base-26 numeral,
+// i.e., 1 -> a, 26 -> z, 27 -> aa.
+func alphaNumeral(n int, a byte) string {
+	buf := make([]byte, 0, 4)
+	for n > 0 {
+		n--
+		buf = append(buf, a+byte(n%26))
+		n /= 26
+	}
+	for i, j := 0, len(buf)-1; i < j; i, j = i+1, j-1 {
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+	return string(buf)
+}
+
+var romanValues = []int{1000, 900, 500, 400, 100, 90, 50, 40, 10, 9, 5, 4, 1}
+var romanSymbols = []string{"M", "CM", "D", "CD", "C", "XC", "L", "XL", "X", "IX", "V", "IV", "I"}
+
+// romanNumeral converts a positive integer to a Roman numeral,
+// numbers above 3999 are written with more "M"s.
+func romanNumeral(n int) string {
+	var sb strings.Builder
+	for i, v := range romanValues {
+		for n >= v {
+			sb.WriteString(romanSymbols[i])
+			n -= v
+		}
+	}
+	return sb.String()
+}
+
+// countNRTotals counts matched paths in each scope, for counters
+// numbering in descending order or with automatic width.
+func countNRTotals(opt *Options, candidates []candidate) {
+	counters := make([]*nrCounter, 0, len(opt.NRCounters))
+	for _, c := range opt.NRCounters {
+		if c.needTotals() {
+			counters = append(counters, c)
+		}
+	}
+	if len(counters) == 0 {
+		return
+	}
+	for _, cand := range candidates {
+		_, filename, _ := splitPath(opt, cand.root, cand.path)
+		if matchedRule(opt, cand.root, cand.path, filename) == nil {
+			continue
+		}
+		for _, c := range counters {
+			c.totals[c.scopeKey(opt, cand.root, cand.path, filename)]++
+		}
+	}
+}
+
+// nextNRValues returns the next numbers of all {nr} placeholders for a path
+func nextNRValues(opt *Options, root string, path string, filename string) map[string]string {
+	values := make(map[string]string, len(opt.NRCounters))
+	for s, c := range opt.NRCounters {
+		values[s] = c.next(c.scopeKey(opt, root, path, filename))
+	}
+	return values
+}
+
+// replaceNRPlaceholders fills {nr} placeholders in the replacement
+func replaceNRPlaceholders(r string, values map[string]string) string {
+	return reNR.ReplaceAllStringFunc(r, func(s string) string {
+		return values[s]
+	})
+}
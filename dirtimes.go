@@ -0,0 +1,113 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// dirTimes records access and modification times of directories, which
+// are changed by renaming paths in them, and restores them later.
+type dirTimes struct {
+	atimes map[string]time.Time
+	mtimes map[string]time.Time
+}
+
+func newDirTimes() *dirTimes {
+	return &dirTimes{
+		atimes: make(map[string]time.Time, 16),
+		mtimes: make(map[string]time.Time, 16),
+	}
+}
+
+// record saves the times of a directory once. For a directory not existing
+// yet, the nearest existing ancestor is recorded, which is changed when
+// creating the directory.
+func (t *dirTimes) record(dir string) {
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, ok := t.mtimes[d]; ok {
+			return
+		}
+		fi, err := os.Stat(d)
+		if err == nil {
+			if fi.IsDir() {
+				t.atimes[d], t.mtimes[d] = fileAtime(fi), fi.ModTime()
+			}
+			return
+		}
+		if !os.IsNotExist(err) || d == filepath.Dir(d) {
+			return
+		}
+	}
+}
+
+// recordUpTo records a directory and its ancestors up to the search root,
+// which might be changed by removing empty directories.
+func (t *dirTimes) recordUpTo(dir string, root string) {
+	root = filepath.Clean(root)
+	for d := filepath.Clean(dir); insideRoot(root, d); d = filepath.Dir(d) {
+		t.record(d)
+	}
+	t.record(root)
+}
+
+// restore sets the recorded times back. moved maps original paths of
+// renamed directories to their new paths, so that times of directories
+// renamed, or under renamed ones, are restored at the new paths.
+// Directories removed are skipped. It returns the first error.
+func (t *dirTimes) restore(moved map[string]string) error {
+	dirs := make([]string, 0, len(t.mtimes))
+	for dir := range t.mtimes {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var first error
+	for _, dir := range dirs {
+		err := os.Chtimes(movedPath(dir, moved), t.atimes[dir], t.mtimes[dir])
+		if err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// movedPath returns the current path of a directory, after its ancestors
+// were renamed from the deepest ones.
+func movedPath(dir string, moved map[string]string) string {
+	if len(moved) == 0 {
+		return dir
+	}
+	cur := dir
+	for a := dir; a != filepath.Dir(a); a = filepath.Dir(a) {
+		target, ok := moved[a]
+		if !ok {
+			continue
+		}
+		if rel, err := filepath.Rel(a, cur); err == nil {
+			cur = filepath.Join(target, rel)
+		}
+	}
+	return cur
+}
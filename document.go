@@ -0,0 +1,581 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+var reDoc = regexp.MustCompile(`\{doc:(title|author|year)(:\d+)?\}`)
+
+// docInfo contains metadata of a document
+type docInfo struct {
+	Title  string
+	Author string
+	Year   string
+}
+
+func (info *docInfo) complete() bool {
+	return info.Title != "" && info.Author != "" && info.Year != ""
+}
+
+// merge fills empty fields with values from another source
+func (info *docInfo) merge(other *docInfo) {
+	if info.Title == "" {
+		info.Title = other.Title
+	}
+	if info.Author == "" {
+		info.Author = other.Author
+	}
+	if info.Year == "" {
+		info.Year = other.Year
+	}
+}
+
+var errUnsupportedDoc = errors.New("unsupported document format")
+
+// readDocInfo reads metadata from PDF, EPUB and OOXML (docx/xlsx/pptx) files
+func readDocInfo(file string) (*docInfo, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, errUnsupportedDoc
+	}
+
+	var magic [5]byte
+	if _, err = io.ReadFull(fh, magic[:]); err != nil {
+		return nil, errUnsupportedDoc
+	}
+
+	switch {
+	case string(magic[:]) == "%PDF-":
+		return readPDFInfo(fh, fi.Size())
+	case string(magic[:4]) == "PK\x03\x04":
+		zr, err := zip.NewReader(fh, fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		return readZippedDocInfo(zr)
+	}
+	return nil, errUnsupportedDoc
+}
+
+// ------------------------------------------------------------------------
+// EPUB and OOXML
+
+func readZipFile(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, maxDocMetaSize))
+	}
+	return nil, os.ErrNotExist
+}
+
+// maximum size of a metadata file or object to load
+const maxDocMetaSize = 16 << 20
+
+func readZippedDocInfo(zr *zip.Reader) (*docInfo, error) {
+	// OOXML
+	if data, err := readZipFile(zr, "docProps/core.xml"); err == nil {
+		var core struct {
+			Title   string   `xml:"title"`
+			Creator []string `xml:"creator"`
+			Created string   `xml:"created"`
+		}
+		if err = xml.Unmarshal(data, &core); err != nil {
+			return nil, err
+		}
+		return &docInfo{
+			Title:  cleanDocValue(core.Title),
+			Author: joinDocValues(core.Creator),
+			Year:   docYear(core.Created),
+		}, nil
+	}
+
+	// EPUB
+	data, err := readZipFile(zr, "META-INF/container.xml")
+	if err != nil {
+		return nil, errUnsupportedDoc
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err = xml.Unmarshal(data, &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, errors.New("EPUB rootfile not found")
+	}
+	data, err = readZipFile(zr, path.Clean(container.Rootfiles[0].FullPath))
+	if err != nil {
+		return nil, err
+	}
+	var opf struct {
+		Title   []string `xml:"metadata>title"`
+		Creator []string `xml:"metadata>creator"`
+		Date    []string `xml:"metadata>date"`
+	}
+	if err = xml.Unmarshal(data, &opf); err != nil {
+		return nil, err
+	}
+	info := &docInfo{Author: joinDocValues(opf.Creator)}
+	if len(opf.Title) > 0 {
+		info.Title = cleanDocValue(opf.Title[0])
+	}
+	if len(opf.Date) > 0 {
+		info.Year = docYear(opf.Date[0])
+	}
+	return info, nil
+}
+
+// ------------------------------------------------------------------------
+// PDF
+
+// size of the head and tail of a PDF file to search for metadata
+const pdfChunkSize = 4 << 20
+
+var rePDFInfoRef = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+var rePDFObjStm = regexp.MustCompile(`/Type\s*/ObjStm`)
+
+// readPDFInfo reads the Info dictionary and the XMP metadata of a PDF file.
+// Only the head and the tail of the file are searched, where the metadata
+// objects are located in most files.
+func readPDFInfo(r io.ReaderAt, size int64) (*docInfo, error) {
+	var data []byte
+	if size <= 2*pdfChunkSize {
+		data = make([]byte, size)
+		if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+	} else {
+		data = make([]byte, 2*pdfChunkSize)
+		if _, err := r.ReadAt(data[:pdfChunkSize], 0); err != nil {
+			return nil, err
+		}
+		if _, err := r.ReadAt(data[pdfChunkSize:], size-pdfChunkSize); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+
+	info := &docInfo{}
+
+	// the last reference wins, as in incrementally updated files
+	refs := rePDFInfoRef.FindAllSubmatch(data, -1)
+	if len(refs) > 0 {
+		ref := refs[len(refs)-1]
+		if dict := pdfFindObject(data, string(ref[1]), string(ref[2])); dict != nil {
+			info = parsePDFInfoDict(dict)
+		}
+	}
+
+	if !info.complete() {
+		if xmp := findXMP(data); xmp != nil {
+			info.merge(parseXMP(xmp))
+		}
+	}
+
+	if *info == (docInfo{}) {
+		return nil, errors.New("no PDF metadata found")
+	}
+	return info, nil
+}
+
+// pdfFindObject returns the content of an indirect object, which might be
+// stored in a compressed object stream.
+func pdfFindObject(data []byte, num string, gen string) []byte {
+	re := regexp.MustCompile(`(?:^|\s)` + num + `\s+` + gen + `\s+obj\b`)
+	locs := re.FindAllIndex(data, -1)
+	if len(locs) > 0 {
+		obj := data[locs[len(locs)-1][1]:]
+		if i := bytes.Index(obj, []byte("endobj")); i >= 0 {
+			obj = obj[:i]
+		}
+		return obj
+	}
+
+	// object streams
+	for _, loc := range rePDFObjStm.FindAllIndex(data, -1) {
+		stm, dict := pdfStream(data, loc[0])
+		if stm == nil {
+			continue
+		}
+		first := pdfDictInt(dict, "First")
+		n := pdfDictInt(dict, "N")
+		if first <= 0 || first > len(stm) || n <= 0 {
+			continue
+		}
+		header := strings.Fields(string(stm[:first]))
+		for i := 0; i+1 < len(header) && i/2 < n; i += 2 {
+			if header[i] != num {
+				continue
+			}
+			offset, err := strconv.Atoi(header[i+1])
+			if err != nil || first+offset >= len(stm) {
+				break
+			}
+			obj := stm[first+offset:]
+			if i+3 < len(header) {
+				if next, err := strconv.Atoi(header[i+3]); err == nil && next > offset && first+next <= len(stm) {
+					obj = stm[first+offset : first+next]
+				}
+			}
+			return obj
+		}
+	}
+	return nil
+}
+
+// pdfStream returns the decoded stream and the dictionary of the object
+// containing the position pos.
+func pdfStream(data []byte, pos int) ([]byte, []byte) {
+	start := bytes.LastIndex(data[:pos], []byte("<<"))
+	if start < 0 {
+		return nil, nil
+	}
+	i := bytes.Index(data[pos:], []byte("stream"))
+	if i < 0 {
+		return nil, nil
+	}
+	dict := data[start : pos+i]
+	body := data[pos+i+len("stream"):]
+	if len(body) > 0 && body[0] == '\r' {
+		body = body[1:]
+	}
+	if len(body) > 0 && body[0] == '\n' {
+		body = body[1:]
+	}
+	if j := bytes.Index(body, []byte("endstream")); j >= 0 {
+		body = body[:j]
+	}
+
+	if !bytes.Contains(dict, []byte("/FlateDecode")) {
+		return body, dict
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil
+	}
+	defer zr.Close()
+	stm, err := io.ReadAll(io.LimitReader(zr, maxDocMetaSize))
+	if err != nil && len(stm) == 0 {
+		return nil, nil
+	}
+	return stm, dict
+}
+
+func pdfDictInt(dict []byte, key string) int {
+	m := regexp.MustCompile(`/` + key + `\s+(\d+)`).FindSubmatch(dict)
+	if m == nil {
+		return 0
+	}
+	v, _ := strconv.Atoi(string(m[1]))
+	return v
+}
+
+func parsePDFInfoDict(dict []byte) *docInfo {
+	info := &docInfo{}
+	info.Title = cleanDocValue(pdfDictString(dict, "Title"))
+	info.Author = cleanDocValue(pdfDictString(dict, "Author"))
+	date := pdfDictString(dict, "CreationDate")
+	if date == "" {
+		date = pdfDictString(dict, "ModDate")
+	}
+	info.Year = docYear(strings.TrimPrefix(date, "D:"))
+	return info
+}
+
+// pdfDictString returns the value of a string entry in a dictionary
+func pdfDictString(dict []byte, key string) string {
+	re := regexp.MustCompile(`/` + key + `\s*([(<])`)
+	loc := re.FindSubmatchIndex(dict)
+	if loc == nil {
+		return ""
+	}
+	if dict[loc[2]] == '(' {
+		return pdfLiteralString(dict[loc[2]+1:])
+	}
+	end := bytes.IndexByte(dict[loc[2]:], '>')
+	if end < 0 {
+		return ""
+	}
+	return pdfHexString(dict[loc[2]+1 : loc[2]+end])
+}
+
+// pdfLiteralString decodes a literal string, data starts after "("
+func pdfLiteralString(data []byte) string {
+	buf := make([]byte, 0, 64)
+	depth := 0
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return pdfTextString(buf)
+			}
+			depth--
+		case '\\':
+			i++
+			if i >= len(data) {
+				break
+			}
+			c = data[i]
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n': // line continuation
+				if c == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+					i++
+				}
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := 0
+					j := 0
+					for ; j < 3 && i+j < len(data) && data[i+j] >= '0' && data[i+j] <= '7'; j++ {
+						v = v*8 + int(data[i+j]-'0')
+					}
+					i += j - 1
+					c = byte(v)
+				}
+			}
+		}
+		buf = append(buf, c)
+	}
+	return pdfTextString(buf)
+}
+
+func pdfHexString(data []byte) string {
+	buf := make([]byte, 0, len(data)/2)
+	var hi, n int
+	for _, c := range data {
+		var v int
+		switch {
+		case c >= '0' && c <= '9':
+			v = int(c - '0')
+		case c >= 'a' && c <= 'f':
+			v = int(c-'a') + 10
+		case c >= 'A' && c <= 'F':
+			v = int(c-'A') + 10
+		default:
+			continue
+		}
+		if n%2 == 0 {
+			hi = v
+		} else {
+			buf = append(buf, byte(hi<<4|v))
+		}
+		n++
+	}
+	if n%2 == 1 {
+		buf = append(buf, byte(hi<<4))
+	}
+	return pdfTextString(buf)
+}
+
+// pdfTextString decodes a text string in UTF-16BE (with BOM), UTF-8 (with BOM)
+// or PDFDocEncoding, which is treated as Latin-1.
+func pdfTextString(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+		b = b[2:]
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+	if len(b) >= 3 && b[0] == 0xEF && b[1] == 0xBB && b[2] == 0xBF {
+		return string(b[3:])
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+// findXMP returns the last uncompressed XMP packet
+func findXMP(data []byte) []byte {
+	start := bytes.LastIndex(data, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return nil
+	}
+	end := bytes.Index(data[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return nil
+	}
+	return data[start : start+end+len("</x:xmpmeta>")]
+}
+
+func parseXMP(data []byte) *docInfo {
+	var xmp struct {
+		Descriptions []struct {
+			Title      []string `xml:"title>Alt>li"`
+			Creator    []string `xml:"creator>Seq>li"`
+			CreateDate string   `xml:"CreateDate"`
+			Date       []string `xml:"date>Seq>li"`
+
+			// the simple forms written as attributes
+			AttrCreateDate string `xml:"http://ns.adobe.com/xap/1.0/ CreateDate,attr"`
+		} `xml:"RDF>Description"`
+	}
+	info := &docInfo{}
+	if err := xml.Unmarshal(data, &xmp); err != nil {
+		return info
+	}
+	for _, d := range xmp.Descriptions {
+		if info.Title == "" && len(d.Title) > 0 {
+			info.Title = cleanDocValue(d.Title[0])
+		}
+		if info.Author == "" {
+			info.Author = joinDocValues(d.Creator)
+		}
+		if info.Year == "" {
+			switch {
+			case d.CreateDate != "":
+				info.Year = docYear(d.CreateDate)
+			case d.AttrCreateDate != "":
+				info.Year = docYear(d.AttrCreateDate)
+			case len(d.Date) > 0:
+				info.Year = docYear(d.Date[0])
+			}
+		}
+	}
+	return info
+}
+
+// ------------------------------------------------------------------------
+
+// cleanDocValue collapses white spaces in a value
+func cleanDocValue(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func joinDocValues(values []string) string {
+	vs := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = cleanDocValue(v); v != "" {
+			vs = append(vs, v)
+		}
+	}
+	return strings.Join(vs, ", ")
+}
+
+var reYear = regexp.MustCompile(`^\s*(\d{4})`)
+
+// docYear extracts the year from dates like 2006-01-02T15:04:05Z or 20060102150405
+func docYear(date string) string {
+	m := reYear.FindStringSubmatch(date)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// truncateValue truncates a value to at most n characters, trying to
+// break at a word boundary.
+func truncateValue(s string, n int) string {
+	r := []rune(s)
+	if n <= 0 || len(r) <= n {
+		return s
+	}
+	t := string(r[:n])
+	if r[n] != ' ' {
+		if i := strings.LastIndexByte(t, ' '); i > len(t)/2 {
+			t = t[:i]
+		}
+	}
+	return strings.TrimRight(t, " ,.;:-_")
+}
+
+// docValue returns the value of a {doc:xxx} placeholder
+func docValue(info *docInfo, field string, maxLen int) (string, bool) {
+	var v string
+	switch field {
+	case "title":
+		v = info.Title
+	case "author":
+		v = info.Author
+	case "year":
+		v = info.Year
+	}
+	if v == "" {
+		return "", false
+	}
+	return truncateValue(v, maxLen), true
+}
+
+// replaceDocPlaceholders fills {doc:xxx} placeholders in the replacement
+func replaceDocPlaceholders(opt *Options, path string, r string) (string, bool) {
+	info, err := readDocInfo(path)
+	if err != nil && opt.Verbose == 0 && !opt.Quiet {
+		log.Warningf("  failed to read document metadata of %s: %s", path, err)
+	}
+
+	return replaceMetadata(opt, reDoc, r, func(m []string) (string, bool) {
+		if err != nil {
+			return "", false
+		}
+		maxLen := opt.DocMaxLen
+		if m[2] != "" {
+			maxLen, _ = strconv.Atoi(m[2][1:])
+		}
+		return docValue(info, m[1], maxLen)
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"os"
+)
+
+// duplicates maps paths of files in duplicate groups to their indexes
+// in the groups. 0 is for the file kept, i.e., the first one.
+var duplicates = make(map[string]int)
+
+// default hash algorithm for detecting duplicates
+var dupHashAlg = "sha256"
+
+// dupGroup is a group of files with identical content
+type dupGroup struct {
+	size   int64
+	digest string
+	files  []string
+}
+
+// findDuplicates detects matched files with identical content. Files are
+// grouped by size first, and only files sharing sizes are hashed.
+// The groups are in the order of their first files in candidates.
+func findDuplicates(opt *Options, candidates []candidate) []*dupGroup {
+	alg := dupHashAlg
+	if len(opt.HashAlgs) > 0 { // reuse computed digests
+		alg = opt.HashAlgs[0]
+	}
+
+	sizes := make(map[int64][]string, len(candidates))
+	order := make([]int64, 0, len(candidates))
+	for _, c := range candidates {
+		if !matchPath(opt, c.root, c.path) {
+			continue
+		}
+		fi, err := os.Lstat(c.path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if _, ok := sizes[fi.Size()]; !ok {
+			order = append(order, fi.Size())
+		}
+		sizes[fi.Size()] = append(sizes[fi.Size()], c.path)
+	}
+
+	files := make([]string, 0, 64)
+	for _, size := range order {
+		if len(sizes[size]) > 1 {
+			files = append(files, sizes[size]...)
+		}
+	}
+	computeHashes(opt, files, []string{alg})
+
+	groups := make([]*dupGroup, 0, 8)
+	for _, size := range order {
+		if len(sizes[size]) < 2 {
+			continue
+		}
+		byDigest := make(map[string]*dupGroup, len(sizes[size]))
+		_groups := make([]*dupGroup, 0, 1)
+		for _, file := range sizes[size] {
+			hashCache.RLock()
+			d, ok := hashCache.m[file][alg]
+			hashCache.RUnlock()
+			if !ok {
+				continue
+			}
+			g, ok := byDigest[d]
+			if !ok {
+				g = &dupGroup{size: size, digest: d, files: make([]string, 0, 2)}
+				byDigest[d] = g
+				_groups = append(_groups, g)
+			}
+			g.files = append(g.files, file)
+		}
+		for _, g := range _groups {
+			if len(g.files) < 2 {
+				continue
+			}
+			groups = append(groups, g)
+			for i, file := range g.files {
+				duplicates[file] = i
+			}
+		}
+	}
+	return groups
+}
+
+// reportDuplicates prints duplicate groups
+func reportDuplicates(groups []*dupGroup) {
+	if len(groups) == 0 {
+		log.Info("no duplicate files found")
+		log.Info()
+		return
+	}
+
+	var n int
+	for _, g := range groups {
+		n += len(g.files) - 1
+	}
+	log.Info(bold("Duplicate files:"))
+	log.Info()
+	for i, g := range groups {
+		log.Infof("  group %d: %d files of %d bytes, digest: %s", i+1, len(g.files), g.size, g.digest)
+		for j, file := range g.files {
+			if j == 0 {
+				log.Infof("    [%s] %s", green("kept"), file)
+			} else {
+				log.Warningf("    [%s] %s", yellow("duplicate"), file)
+			}
+		}
+	}
+	log.Info()
+	log.Infof("%d duplicate(s) in %d group(s)", n, len(groups))
+	log.Info()
+}
@@ -0,0 +1,151 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var reStemExt = regexp.MustCompile(`\{(stem|ext)\}`)
+
+// default multi-part extensions treated as a whole
+var defaultCompoundExts = []string{
+	".tar.gz", ".tar.bz2", ".tar.xz", ".tar.zst", ".tar.lz4",
+	".fastq.gz", ".fq.gz", ".fasta.gz", ".fa.gz", ".fna.gz", ".faa.gz",
+	".sam.gz", ".vcf.gz", ".bed.gz", ".gff.gz", ".gff3.gz", ".gtf.gz",
+	".vcf.gz.tbi", ".vcf.gz.csi", ".bed.gz.tbi",
+	".nii.gz", ".txt.gz", ".csv.gz", ".tsv.gz", ".json.gz",
+}
+
+// parseCompoundExts checks and lowercases compound extensions,
+// and sorts them by length in descending order for matching.
+func parseCompoundExts(exts []string) ([]string, error) {
+	list := make([]string, 0, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if ext[0] != '.' {
+			ext = "." + ext
+		}
+		if strings.Count(ext, ".") < 2 || strings.Contains(ext, "..") || strings.ContainsAny(ext, `/\`) {
+			return nil, fmt.Errorf("invalid compound extension: %s, it should contain two or more parts, e.g., .tar.gz", ext)
+		}
+		list = append(list, ext)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i]) == len(list[j]) {
+			return list[i] < list[j]
+		}
+		return len(list[i]) > len(list[j])
+	})
+	return list, nil
+}
+
+// splitExt splits a file name into the stem and the extension (with the
+// leading dot). Compound extensions are matched case-insensitively first.
+func splitExt(opt *Options, name string) (string, string) {
+	lower := strings.ToLower(name)
+	for _, ext := range opt.CompoundExts {
+		if len(ext) < len(name) && strings.HasSuffix(lower, ext) {
+			return name[:len(name)-len(ext)], name[len(name)-len(ext):]
+		}
+	}
+	ext := filepath.Ext(name)
+	return name[:len(name)-len(ext)], ext
+}
+
+// replaceStemExtPlaceholders fills {stem} and {ext} in the replacement,
+// with the stem and the extension (without the leading dot) of the file name.
+func replaceStemExtPlaceholders(opt *Options, path string, r string) string {
+	stem, ext := splitExt(opt, filepath.Base(path))
+	ext = strings.TrimPrefix(ext, ".")
+	return reStemExt.ReplaceAllStringFunc(r, func(s string) string {
+		if s == "{stem}" {
+			return escapeReplacement(stem)
+		}
+		return escapeReplacement(ext)
+	})
+}
+
+// default canonical extensions (without leading dots), applied after
+// extensions are lowercased by --normalize-ext
+var defaultExtMap = map[string]string{
+	"jpeg":     "jpg",
+	"jpe":      "jpg",
+	"tif":      "tiff",
+	"htm":      "html",
+	"yml":      "yaml",
+	"mpeg":     "mpg",
+	"fq":       "fastq",
+	"fq.gz":    "fastq.gz",
+	"fa":       "fasta",
+	"fa.gz":    "fasta.gz",
+	"tgz":      "tar.gz",
+	"tbz2":     "tar.bz2",
+	"txz":      "tar.xz",
+	"markdown": "md",
+}
+
+// loadExtMap returns the default extension map, updated with a
+// tab-delimited file of synonyms and canonical extensions, if given.
+func loadExtMap(file string) (map[string]string, error) {
+	m := make(map[string]string, len(defaultExtMap))
+	for k, v := range defaultExtMap {
+		m[k] = v
+	}
+	if file == "" {
+		return m, nil
+	}
+	kvs, err := readKVs(file, true)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range kvs {
+		k = strings.TrimPrefix(strings.TrimSpace(k), ".")
+		v = strings.TrimPrefix(strings.TrimSpace(v), ".")
+		if k == "" || v == "" {
+			continue
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// normalizeExt lowercases the extension of a file name and replaces it
+// with the canonical one in the extension map. Names without stems,
+// e.g., hidden files like .bashrc, are not changed.
+func normalizeExt(opt *Options, name string) string {
+	stem, ext := splitExt(opt, name)
+	if stem == "" || ext == "" {
+		return name
+	}
+	e := strings.ToLower(ext[1:])
+	if v, ok := opt.ExtMap[e]; ok {
+		e = v
+	}
+	return stem + "." + e
+}
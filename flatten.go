@@ -0,0 +1,94 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// flattenDir returns the destination directory of --flatten
+func flattenDir(opt *Options, root string) string {
+	if opt.FlattenDest == "" {
+		return filepath.Clean(root)
+	}
+	if filepath.IsAbs(opt.FlattenDest) {
+		return filepath.Clean(opt.FlattenDest)
+	}
+	return filepath.Join(root, opt.FlattenDest)
+}
+
+// flattenName prefixes the new file name with directories of the path
+// relative to the search root, joined with the separator, e.g.,
+// a/b/c.txt -> a_b_c.txt. Files already in the destination are not changed.
+func flattenName(opt *Options, root string, path string, dest string, name string) string {
+	dir := filepath.Dir(filepath.Clean(path))
+	if dir == dest {
+		return name
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." {
+		return name
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	return strings.Join(append(parts, name), opt.FlattenSep)
+}
+
+// pruneEmptyDirs removes directories which became empty, from the deepest
+// ones, and then their parents which also became empty. Search roots,
+// which are the values of dirs, and their ancestors are never removed.
+// Directories removed are returned in order.
+func pruneEmptyDirs(dirs map[string]string) []string {
+	list := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		list = append(list, dir)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		ni, nj := strings.Count(list[i], string(filepath.Separator)), strings.Count(list[j], string(filepath.Separator))
+		if ni == nj {
+			return list[i] > list[j]
+		}
+		return ni > nj
+	})
+
+	removed := make([]string, 0, len(list))
+	done := make(map[string]struct{}, len(list))
+	for _, dir := range list {
+		root := dirs[dir]
+		for d := dir; insideRoot(root, d); d = filepath.Dir(d) {
+			if _, ok := done[d]; ok {
+				break
+			}
+			entries, err := os.ReadDir(d)
+			if err != nil || len(entries) > 0 {
+				break
+			}
+			if os.Remove(d) != nil {
+				break
+			}
+			done[d] = struct{}{}
+			removed = append(removed, d)
+		}
+	}
+	return removed
+}
@@ -10,6 +10,8 @@ require (
 	github.com/shenwei356/natsort v0.0.0-20220117010048-580176ad49fb
 	github.com/shenwei356/util v0.5.1
 	github.com/spf13/cobra v1.6.1
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/sys v0.6.0
 )
 
 require (
@@ -21,8 +23,6 @@ require (
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
 	github.com/shenwei356/xopen v0.3.1 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/twotwotwo/sorts v0.0.0-20160814051341-bf5c1f2b8553 // indirect
 	github.com/ulikunitz/xz v0.5.14 // indirect
-	golang.org/x/sys v0.6.0 // indirect
 )
@@ -0,0 +1,279 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// targets of guards
+const (
+	guardName = iota // the current file name
+	guardPath        // the path
+	guardType        // the file type
+)
+
+// guard is a condition for applying rules
+type guard struct {
+	target int
+	re     *regexp.Regexp
+	types  map[string]struct{}
+	negate bool
+}
+
+// kinds of paths can be checked by type guards, besides file types
+// identified by magic bytes.
+var pathKinds = []string{"dir", "file", "symlink"}
+
+// fileTypeKeys maps file types to their short names in fileTypes
+var fileTypeKeys = make(map[*fileType]string, len(fileTypes))
+
+func init() {
+	for k, t := range fileTypes {
+		fileTypeKeys[t] = k
+	}
+}
+
+// newGuard creates a guard from the value of --when and --unless:
+//
+//	REGEX             the file name matches the regular expression
+//	path:REGEX        the path relative to the search root matches the regular expression
+//	type:NAME[,NAME]  the file type is one of the names
+func newGuard(expr string, ignoreCase bool, negate bool) (*guard, error) {
+	switch {
+	case strings.HasPrefix(expr, "path:"):
+		return newRegexGuard(guardPath, expr[5:], ignoreCase, negate)
+	case strings.HasPrefix(expr, "type:"):
+		return newTypeGuard(expr[5:], negate)
+	}
+	return newRegexGuard(guardName, expr, ignoreCase, negate)
+}
+
+// orderedFlag is a value of -p/--pattern, --when or --unless
+type orderedFlag struct {
+	name  string
+	value string
+}
+
+// orderedFlags are values of -p/--pattern, --when and --unless in the order
+// given in the command line, for assigning guards to rules.
+var orderedFlags []orderedFlag
+
+// orderedValue wraps the value of a flag, and records each value given
+// into orderedFlags.
+type orderedValue struct {
+	pflag.Value
+	name string
+}
+
+func (v *orderedValue) Set(value string) error {
+	if err := v.Value.Set(value); err != nil {
+		return err
+	}
+	orderedFlags = append(orderedFlags, orderedFlag{v.name, value})
+	return nil
+}
+
+// recordFlagOrder makes values of the flags recorded into orderedFlags.
+func recordFlagOrder(flags *pflag.FlagSet, names ...string) {
+	for _, name := range names {
+		f := flags.Lookup(name)
+		f.Value = &orderedValue{Value: f.Value, name: name}
+	}
+}
+
+// ruleGuards parses guards of --when and --unless, and assigns them to
+// rules by the order of flags: a guard belongs to the rule of the last
+// -p/--pattern before it. Guards given before any -p/--pattern apply to
+// all rules, and are returned separately.
+func ruleGuards(flags []orderedFlag, ignoreCase bool) ([]*guard, map[int][]*guard, error) {
+	global := make([]*guard, 0, 1)
+	perRule := make(map[int][]*guard, 1)
+
+	var nPatterns int
+	for _, f := range flags {
+		switch f.name {
+		case "pattern":
+			nPatterns++
+		case "when", "unless":
+			g, err := newGuard(f.value, ignoreCase, f.name == "unless")
+			if err != nil {
+				return nil, nil, fmt.Errorf("flag --%s: %s", f.name, err)
+			}
+			if nPatterns == 0 {
+				global = append(global, g)
+			} else {
+				perRule[nPatterns-1] = append(perRule[nPatterns-1], g)
+			}
+		}
+	}
+	return global, perRule, nil
+}
+
+func newRegexGuard(target int, pattern string, ignoreCase bool, negate bool) (*guard, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty regular expression in guard")
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("illegal regular expression in guard: %s", pattern)
+	}
+	return &guard{target: target, re: re, negate: negate}, nil
+}
+
+func newTypeGuard(names string, negate bool) (*guard, error) {
+	g := &guard{target: guardType, types: make(map[string]struct{}, 1), negate: negate}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := fileTypes[name]; !ok && !isPathKind(name) {
+			return nil, fmt.Errorf("unknown type in guard: %s, available: %s", name, strings.Join(availableTypes(), ", "))
+		}
+		g.types[name] = struct{}{}
+	}
+	return g, nil
+}
+
+func isPathKind(name string) bool {
+	for _, k := range pathKinds {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+func availableTypes() []string {
+	names := make([]string, 0, len(fileTypes))
+	for k := range fileTypes {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return append(append([]string{}, pathKinds...), names...)
+}
+
+// parseGuard parses a guard in scripts, and returns the remaining text:
+//
+//	/REGEX/           the file name matches the regular expression
+//	path:/REGEX/      the path relative to the search root matches the regular expression
+//	type:NAME[,NAME]  the file type is one of the names
+//
+// A leading "!" negates the guard.
+func parseGuard(s string, ignoreCase bool) (*guard, string, error) {
+	var negate bool
+	if strings.HasPrefix(s, "!") {
+		negate = true
+		s = strings.TrimSpace(s[1:])
+	}
+
+	if strings.HasPrefix(s, "type:") {
+		s = s[5:]
+		i := strings.IndexAny(s, " \t")
+		if i < 0 {
+			i = len(s)
+		}
+		g, err := newTypeGuard(s[:i], negate)
+		return g, s[i:], err
+	}
+
+	target := guardName
+	if strings.HasPrefix(s, "path:") {
+		target = guardPath
+		s = s[5:]
+	}
+	if s == "" || s[0] != '/' {
+		return nil, "", fmt.Errorf("guard should be /REGEX/, path:/REGEX/ or type:NAME: %s", s)
+	}
+	pattern, rest, ok := readDelimited(s[1:], '/')
+	if !ok {
+		return nil, "", fmt.Errorf("incomplete regular expression in guard: %s", s)
+	}
+	g, err := newRegexGuard(target, pattern, ignoreCase, negate)
+	return g, rest, err
+}
+
+// cache of types of paths, as guards may be checked multiple times
+var pathTypeCache = make(map[string]string, 1024)
+
+// pathType returns the short name of the file type identified by magic
+// bytes, or the kind of path, i.e., dir, file or symlink.
+func pathType(path string) string {
+	if t, ok := pathTypeCache[path]; ok {
+		return t
+	}
+	var t string
+	if fi, err := os.Lstat(path); err == nil {
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			t = "symlink"
+		case fi.IsDir():
+			t = "dir"
+		default:
+			t = "file"
+			if ft := sniffFileType(path); ft != nil {
+				t = fileTypeKeys[ft]
+			}
+		}
+	}
+	pathTypeCache[path] = t
+	return t
+}
+
+// match checks if a path satisfies the guard. Paths are matched relative
+// to the search root with "/" as the separator, like -P/--match-path.
+func (g *guard) match(root string, path string, name string) bool {
+	var ok bool
+	switch g.target {
+	case guardName:
+		ok = g.re.MatchString(name)
+	case guardPath:
+		if rel, err := filepath.Rel(root, path); err == nil && rel != "." {
+			path = rel
+		}
+		ok = g.re.MatchString(filepath.ToSlash(path))
+	case guardType:
+		t := pathType(path)
+		_, ok = g.types[t]
+		if !ok && t != "dir" && t != "symlink" && t != "" {
+			_, ok = g.types["file"]
+		}
+	}
+	return ok != g.negate
+}
+
+// checkGuards checks if all guards are satisfied
+func checkGuards(guards []*guard, root string, path string, name string) bool {
+	for _, g := range guards {
+		if !g.match(root, path, name) {
+			return false
+		}
+	}
+	return true
+}
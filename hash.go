@@ -0,0 +1,209 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var reHash = regexp.MustCompile(`\{(md5|sha1|sha256|sha512)(:\d+)?\}`)
+
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// hashCache stores hex digests of files computed by the worker pool
+var hashCache = struct {
+	sync.RWMutex
+	m map[string]map[string]string // path -> algorithm -> hex digest
+}{m: make(map[string]map[string]string, 1024)}
+
+// hashAlgorithms returns the hash algorithms used in the replacement
+func hashAlgorithms(r string) []string {
+	algs := make([]string, 0, 1)
+	seen := make(map[string]struct{}, 1)
+	for _, m := range reHash.FindAllStringSubmatch(r, -1) {
+		if _, ok := seen[m[1]]; !ok {
+			seen[m[1]] = struct{}{}
+			algs = append(algs, m[1])
+		}
+	}
+	sort.Strings(algs)
+	return algs
+}
+
+// hashFile computes digests of a file with multiple algorithms in one pass
+func hashFile(file string, algs []string) (map[string]string, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("not a regular file: %s", file)
+	}
+
+	hashers := make([]hash.Hash, len(algs))
+	writers := make([]io.Writer, len(algs))
+	for i, alg := range algs {
+		hashers[i] = hashFuncs[alg]()
+		writers[i] = hashers[i]
+	}
+	if _, err = io.Copy(io.MultiWriter(writers...), fh); err != nil {
+		return nil, err
+	}
+
+	digests := make(map[string]string, len(algs))
+	for i, alg := range algs {
+		digests[alg] = hex.EncodeToString(hashers[i].Sum(nil))
+	}
+	return digests, nil
+}
+
+// computeHashes hashes files with a bounded pool of workers, the digests
+// are saved in hashCache. Files failed to hash are reported in verbose mode
+// and left out of the cache.
+func computeHashes(opt *Options, files []string, algs []string) {
+	if len(files) == 0 || len(algs) == 0 {
+		return
+	}
+	threads := opt.Threads
+	if threads > len(files) {
+		threads = len(files)
+	}
+	showProgress := !opt.Quiet && !opt.DryRun && !opt.ListPath
+
+	jobs := make(chan string, threads)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var n int
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				digests, err := hashFile(file, algs)
+
+				hashCache.Lock()
+				if err == nil {
+					if _, ok := hashCache.m[file]; !ok {
+						hashCache.m[file] = make(map[string]string, len(algs))
+					}
+					for alg, d := range digests {
+						hashCache.m[file][alg] = d
+					}
+				}
+				hashCache.Unlock()
+
+				mu.Lock()
+				n++
+				if err != nil && opt.Verbose == 0 && !opt.Quiet {
+					log.Warningf("  failed to hash %s: %s", file, err)
+				}
+				if showProgress {
+					fmt.Fprintf(os.Stderr, "\r  %-78s", fmt.Sprintf("hashing files: %d/%d", n, len(files)))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, file := range files {
+		jobs <- file
+	}
+	close(jobs)
+	wg.Wait()
+
+	if showProgress {
+		fmt.Fprintf(os.Stderr, "\r  %-78s\n", green("Done hashing."))
+	}
+}
+
+// fileHash returns the cached digest of a file, it computes the digest
+// if not cached, e.g., for existing files not matched.
+func fileHash(file string, alg string) (string, bool) {
+	hashCache.RLock()
+	d, ok := hashCache.m[file][alg]
+	hashCache.RUnlock()
+	if ok {
+		return d, true
+	}
+
+	digests, err := hashFile(file, []string{alg})
+	if err != nil {
+		return "", false
+	}
+	hashCache.Lock()
+	if _, ok = hashCache.m[file]; !ok {
+		hashCache.m[file] = make(map[string]string, 1)
+	}
+	hashCache.m[file][alg] = digests[alg]
+	hashCache.Unlock()
+	return digests[alg], true
+}
+
+// sameContent checks if two files have identical content by comparing
+// digests of the given algorithm.
+func sameContent(file1, file2 string, alg string) bool {
+	d1, ok := fileHash(file1, alg)
+	if !ok {
+		return false
+	}
+	d2, ok := fileHash(file2, alg)
+	return ok && d1 == d2
+}
+
+// replaceHashPlaceholders fills {md5}, {sha1}, {sha256} and {sha512} in the replacement
+func replaceHashPlaceholders(opt *Options, path string, r string) (string, bool) {
+	return replaceMetadata(opt, reHash, r, func(m []string) (string, bool) {
+		hashCache.RLock()
+		d, ok := hashCache.m[path][m[1]]
+		hashCache.RUnlock()
+		if !ok {
+			return "", false
+		}
+		if m[2] != "" {
+			if n, _ := strconv.Atoi(m[2][1:]); n > 0 && n < len(d) {
+				d = d[:n]
+			}
+		}
+		return d, true
+	})
+}
@@ -0,0 +1,517 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var reImage = regexp.MustCompile(`\{(width|height|orientation)(:exif)?\}`)
+
+// imageInfo contains dimensions and EXIF tags read from image headers.
+// Width and Height are the display size, i.e., with the EXIF orientation applied.
+type imageInfo struct {
+	Width       int
+	Height      int
+	Orientation int // EXIF orientation, 1-8, 0 for missing
+
+	Exif exifTags
+}
+
+var errUnsupportedImage = errors.New("unsupported image format")
+
+// maximum size of an EXIF block to load
+const maxExifSize = 1 << 20
+
+// readImageInfo reads dimensions and EXIF tags from headers of PNG, JPEG,
+// GIF, WebP, TIFF and BMP files, without decoding pixels.
+func readImageInfo(file string) (*imageInfo, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, errUnsupportedImage
+	}
+
+	var magic [12]byte
+	n, _ := io.ReadFull(fh, magic[:])
+	if _, err = fh.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	m := magic[:n]
+
+	var info *imageInfo
+	switch {
+	case bytes.HasPrefix(m, []byte("\x89PNG\r\n\x1a\n")):
+		info, err = readPNGInfo(fh)
+	case bytes.HasPrefix(m, []byte{0xFF, 0xD8}):
+		info, err = readJPEGInfo(fh)
+	case bytes.HasPrefix(m, []byte("GIF87a")) || bytes.HasPrefix(m, []byte("GIF89a")):
+		info, err = readGIFInfo(m)
+	case len(m) == 12 && string(m[:4]) == "RIFF" && string(m[8:12]) == "WEBP":
+		info, err = readWebPInfo(fh)
+	case bytes.HasPrefix(m, []byte("II*\x00")) || bytes.HasPrefix(m, []byte("MM\x00*")):
+		info, err = readTIFFInfo(fh)
+	case bytes.HasPrefix(m, []byte("BM")):
+		info, err = readBMPInfo(fh)
+	default:
+		return nil, errUnsupportedImage
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := info.Exif.Int(exifTagOrientation); ok && v >= 1 && v <= 8 {
+		info.Orientation = v
+		if v >= 5 { // rotated by 90 or 270 degrees
+			info.Width, info.Height = info.Height, info.Width
+		}
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, errors.New("invalid image size")
+	}
+	return info, nil
+}
+
+func readPNGInfo(r io.ReadSeeker) (*imageInfo, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if string(hdr[12:16]) != "IHDR" {
+		return nil, errors.New("PNG IHDR chunk not found")
+	}
+	info := &imageInfo{
+		Width:  int(binary.BigEndian.Uint32(hdr[16:20])),
+		Height: int(binary.BigEndian.Uint32(hdr[20:24])),
+	}
+
+	// eXIf chunk before the image data
+	offset := int64(8 + 8 + 13 + 4)
+	var chunk [8]byte
+	for {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			break
+		}
+		size := int64(binary.BigEndian.Uint32(chunk[:4]))
+		typ := string(chunk[4:8])
+		if typ == "IDAT" || typ == "IEND" {
+			break
+		}
+		if typ == "eXIf" && size <= maxExifSize {
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err == nil {
+				info.Exif = parseTIFF(data, false)
+			}
+			break
+		}
+		offset += 8 + size + 4
+	}
+	return info, nil
+}
+
+func readJPEGInfo(r io.ReadSeeker) (*imageInfo, error) {
+	info := &imageInfo{}
+	offset := int64(2)
+	var hdr [4]byte
+	var sof [5]byte
+	for {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+			return nil, err
+		}
+		if hdr[0] != 0xFF {
+			return nil, errors.New("invalid JPEG marker")
+		}
+		marker := hdr[1]
+		if marker == 0xFF { // fill byte
+			offset++
+			continue
+		}
+		if marker == 0x01 || marker >= 0xD0 && marker <= 0xD8 { // no length
+			offset += 2
+			continue
+		}
+		if marker == 0xD9 || marker == 0xDA { // EOI, SOS
+			break
+		}
+		if _, err := io.ReadFull(r, hdr[2:4]); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint16(hdr[2:4]))
+		if size < 2 {
+			return nil, errors.New("invalid JPEG segment size")
+		}
+
+		switch {
+		case marker == 0xE1 && info.Exif == nil: // APP1
+			data := make([]byte, size-2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			if bytes.HasPrefix(data, []byte("Exif\x00\x00")) {
+				info.Exif = parseTIFF(data[6:], false)
+			}
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC: // SOFn
+			if _, err := io.ReadFull(r, sof[:]); err != nil {
+				return nil, err
+			}
+			info.Height = int(binary.BigEndian.Uint16(sof[1:3]))
+			info.Width = int(binary.BigEndian.Uint16(sof[3:5]))
+			return info, nil
+		}
+		offset += 2 + size
+	}
+	if info.Width == 0 {
+		return nil, errors.New("JPEG SOF segment not found")
+	}
+	return info, nil
+}
+
+func readGIFInfo(hdr []byte) (*imageInfo, error) {
+	if len(hdr) < 10 {
+		return nil, errors.New("truncated GIF header")
+	}
+	return &imageInfo{
+		Width:  int(binary.LittleEndian.Uint16(hdr[6:8])),
+		Height: int(binary.LittleEndian.Uint16(hdr[8:10])),
+	}, nil
+}
+
+func readWebPInfo(r io.ReadSeeker) (*imageInfo, error) {
+	info := &imageInfo{}
+	offset := int64(12)
+	var chunk [8]byte
+	var data [10]byte
+	for {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+		switch string(chunk[:4]) {
+		case "VP8X":
+			if _, err := io.ReadFull(r, data[:]); err != nil {
+				return nil, err
+			}
+			info.Width = int(uint32(data[4])|uint32(data[5])<<8|uint32(data[6])<<16) + 1
+			info.Height = int(uint32(data[7])|uint32(data[8])<<8|uint32(data[9])<<16) + 1
+		case "VP8 ":
+			if _, err := io.ReadFull(r, data[:]); err != nil {
+				return nil, err
+			}
+			if info.Width == 0 {
+				info.Width = int(binary.LittleEndian.Uint16(data[6:8]) & 0x3FFF)
+				info.Height = int(binary.LittleEndian.Uint16(data[8:10]) & 0x3FFF)
+			}
+			return info, nil
+		case "VP8L":
+			if _, err := io.ReadFull(r, data[:5]); err != nil {
+				return nil, err
+			}
+			if info.Width == 0 {
+				bits := binary.LittleEndian.Uint32(data[1:5])
+				info.Width = int(bits&0x3FFF) + 1
+				info.Height = int(bits>>14&0x3FFF) + 1
+			}
+			return info, nil
+		case "EXIF":
+			if size <= maxExifSize {
+				buf := make([]byte, size)
+				if _, err := io.ReadFull(r, buf); err == nil {
+					buf = bytes.TrimPrefix(buf, []byte("Exif\x00\x00"))
+					info.Exif = parseTIFF(buf, false)
+				}
+			}
+		}
+		offset += 8 + size + size%2
+	}
+	if info.Width == 0 {
+		return nil, errors.New("WebP image size not found")
+	}
+	return info, nil
+}
+
+func readTIFFInfo(r io.Reader) (*imageInfo, error) {
+	// tags might locate anywhere, read the first megabytes
+	data, err := io.ReadAll(io.LimitReader(r, maxExifSize))
+	if err != nil {
+		return nil, err
+	}
+	tags := parseTIFF(data, true)
+	info := &imageInfo{Exif: tags}
+	info.Width, _ = tags.Int(tiffTagImageWidth)
+	info.Height, _ = tags.Int(tiffTagImageLength)
+	return info, nil
+}
+
+func readBMPInfo(r io.Reader) (*imageInfo, error) {
+	var hdr [26]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	info := &imageInfo{}
+	if binary.LittleEndian.Uint32(hdr[14:18]) == 12 { // OS/2 BITMAPCOREHEADER
+		info.Width = int(binary.LittleEndian.Uint16(hdr[18:20]))
+		info.Height = int(binary.LittleEndian.Uint16(hdr[20:22]))
+	} else {
+		info.Width = int(int32(binary.LittleEndian.Uint32(hdr[18:22])))
+		info.Height = int(int32(binary.LittleEndian.Uint32(hdr[22:26])))
+		if info.Height < 0 { // top-down bitmap
+			info.Height = -info.Height
+		}
+	}
+	return info, nil
+}
+
+// ------------------------------------------------------------------------
+// EXIF
+
+const (
+	tiffTagImageWidth  = 0x0100
+	tiffTagImageLength = 0x0101
+	exifTagOrientation = 0x0112
+	exifTagExifIFD     = 0x8769
+)
+
+// exifTags stores values of EXIF tags in IFD0 and the Exif sub-IFD,
+// numbers are formatted as decimal strings.
+type exifTags map[uint16]string
+
+// Int returns the integer value of a tag
+func (tags exifTags) Int(tag uint16) (int, bool) {
+	v, ok := tags[tag]
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(v)
+	return i, err == nil
+}
+
+// parseTIFF parses tags in a TIFF structure, which is also used by EXIF.
+// Only the first value of each tag is kept.
+func parseTIFF(data []byte, image bool) exifTags {
+	tags := make(exifTags)
+	if len(data) < 8 {
+		return tags
+	}
+	var bo binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return tags
+	}
+
+	parseIFD := func(offset uint32) {
+		if uint64(offset)+2 > uint64(len(data)) {
+			return
+		}
+		n := int(bo.Uint16(data[offset:]))
+		for i := 0; i < n; i++ {
+			e := int(offset) + 2 + 12*i
+			if e+12 > len(data) {
+				return
+			}
+			tag := bo.Uint16(data[e:])
+			typ := bo.Uint16(data[e+2:])
+			count := bo.Uint32(data[e+4:])
+			if v, ok := tiffValue(data, bo, typ, count, data[e+8:e+12]); ok {
+				if _, existed := tags[tag]; !existed {
+					tags[tag] = v
+				}
+			}
+		}
+	}
+
+	parseIFD(bo.Uint32(data[4:8]))
+	if v, ok := tags.Int(exifTagExifIFD); ok && v > 0 {
+		parseIFD(uint32(v))
+	}
+
+	if !image { // dimensions of thumbnails or the raw image are not wanted
+		delete(tags, tiffTagImageWidth)
+		delete(tags, tiffTagImageLength)
+	}
+	return tags
+}
+
+// tiffValue formats the value of an IFD entry
+func tiffValue(data []byte, bo binary.ByteOrder, typ uint16, count uint32, field []byte) (string, bool) {
+	var size uint32
+	switch typ {
+	case 1, 2, 6, 7: // BYTE, ASCII, SBYTE, UNDEFINED
+		size = 1
+	case 3, 8: // SHORT, SSHORT
+		size = 2
+	case 4, 9: // LONG, SLONG
+		size = 4
+	case 5, 10: // RATIONAL, SRATIONAL
+		size = 8
+	default:
+		return "", false
+	}
+	if count == 0 || uint64(count)*uint64(size) > maxExifSize {
+		return "", false
+	}
+
+	value := field
+	if count*size > 4 {
+		offset := bo.Uint32(field)
+		if uint64(offset)+uint64(count*size) > uint64(len(data)) {
+			return "", false
+		}
+		value = data[offset : offset+count*size]
+	}
+
+	switch typ {
+	case 1:
+		return strconv.Itoa(int(value[0])), true
+	case 2:
+		s := string(value[:count])
+		if i := strings.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		s = strings.TrimSpace(s)
+		return s, s != ""
+	case 3:
+		return strconv.Itoa(int(bo.Uint16(value))), true
+	case 4:
+		return strconv.FormatUint(uint64(bo.Uint32(value)), 10), true
+	case 8:
+		return strconv.Itoa(int(int16(bo.Uint16(value)))), true
+	case 9:
+		return strconv.Itoa(int(int32(bo.Uint32(value)))), true
+	case 5:
+		return fmt.Sprintf("%d/%d", bo.Uint32(value), bo.Uint32(value[4:])), true
+	case 10:
+		return fmt.Sprintf("%d/%d", int32(bo.Uint32(value)), int32(bo.Uint32(value[4:]))), true
+	}
+	return "", false
+}
+
+// ------------------------------------------------------------------------
+
+// imageValue returns the value of {width}, {height} or {orientation}
+func imageValue(info *imageInfo, field string, exif bool) (string, bool) {
+	switch field {
+	case "width":
+		return strconv.Itoa(info.Width), true
+	case "height":
+		return strconv.Itoa(info.Height), true
+	case "orientation":
+		if exif {
+			if info.Orientation == 0 {
+				return "", false
+			}
+			return strconv.Itoa(info.Orientation), true
+		}
+		switch {
+		case info.Width > info.Height:
+			return "landscape", true
+		case info.Width < info.Height:
+			return "portrait", true
+		default:
+			return "square", true
+		}
+	}
+	return "", false
+}
+
+// replaceImagePlaceholders fills {width}, {height} and {orientation} in the replacement
+func replaceImagePlaceholders(opt *Options, path string, r string) (string, bool) {
+	info, err := readImageInfo(path)
+	if err != nil && opt.Verbose == 0 && !opt.Quiet {
+		log.Warningf("  failed to read image size of %s: %s", path, err)
+	}
+
+	return replaceMetadata(opt, reImage, r, func(m []string) (string, bool) {
+		if err != nil {
+			return "", false
+		}
+		return imageValue(info, m[1], m[2] != "")
+	})
+}
+
+// parseImageSize parses a size in the format of WxH, where W or H could be
+// empty or 0 for no limit.
+func parseImageSize(s string) ([2]int, error) {
+	var size [2]int
+	if s == "" {
+		return size, nil
+	}
+	items := strings.Split(strings.ToLower(s), "x")
+	if len(items) != 2 {
+		return size, fmt.Errorf("invalid image size: %s, it should be in the format of WxH", s)
+	}
+	for i, item := range items {
+		if item == "" {
+			continue
+		}
+		v, err := strconv.Atoi(item)
+		if err != nil || v < 0 {
+			return size, fmt.Errorf("invalid image size: %s, it should be in the format of WxH", s)
+		}
+		size[i] = v
+	}
+	return size, nil
+}
+
+// filterImageSize checks if an image should be skipped by its size.
+// Files not being supported images are skipped.
+func filterImageSize(opt *Options, path string) bool {
+	info, err := readImageInfo(path)
+	if err != nil {
+		return true
+	}
+	min, max := opt.ImageMinSize, opt.ImageMaxSize
+	if min[0] > 0 && info.Width < min[0] || min[1] > 0 && info.Height < min[1] {
+		return true
+	}
+	if max[0] > 0 && info.Width > max[0] || max[1] > 0 && info.Height > max[1] {
+		return true
+	}
+	return false
+}
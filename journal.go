@@ -0,0 +1,133 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// delimiter of fields in .brename_detail.txt
+const journalDelimiter = "\t_shenwei356-brename_\t"
+
+// Kinds of operations in .brename_detail.txt. Renaming is recorded as
+// "source<delimiter>target" for compatibility, other operations are
+// recorded as "kind<delimiter>source<delimiter>target".
+const (
+	journalRename = "rename"
+	journalMkdir  = "mkdir"  // target is the directory created
+	journalRmdir  = "rmdir"  // target is the empty directory removed
+	journalMove   = "move"   // source moved to target on another file system
+	journalCreate = "create" // target created from source by copying or linking
+)
+
+// journalEntry is an operation recorded in .brename_detail.txt
+type journalEntry struct {
+	kind   string
+	source string
+	target string
+}
+
+func (e journalEntry) String() string {
+	if e.kind == journalRename {
+		return e.source + journalDelimiter + e.target
+	}
+	return e.kind + journalDelimiter + e.source + journalDelimiter + e.target
+}
+
+// parseJournalLine parses a line of .brename_detail.txt. Lines of unknown
+// kinds are ignored.
+func parseJournalLine(line string) (journalEntry, bool) {
+	items := strings.Split(line, journalDelimiter)
+	switch len(items) {
+	case 2:
+		return journalEntry{journalRename, items[0], items[1]}, true
+	case 3:
+		switch items[0] {
+		case journalMkdir, journalRmdir, journalMove, journalCreate:
+			return journalEntry{items[0], items[1], items[2]}, true
+		}
+	}
+	return journalEntry{}, false
+}
+
+// undo reverts an operation
+func (e journalEntry) undo() error {
+	switch e.kind {
+	case journalRename:
+		return os.Rename(e.target, e.source)
+	case journalMkdir:
+		return os.Remove(e.target)
+	case journalRmdir:
+		return os.Mkdir(e.target, 0755)
+	case journalMove:
+		return moveAcrossDevices(e.target, e.source, "", false)
+	case journalCreate:
+		return os.Remove(e.target)
+	}
+	return fmt.Errorf("unknown operation: %s", e.kind)
+}
+
+// undoString describes the reverted operation
+func (e journalEntry) undoString() string {
+	switch e.kind {
+	case journalMkdir:
+		return fmt.Sprintf("removed directory %s", e.target)
+	case journalRmdir:
+		return fmt.Sprintf("recreated directory %s", e.target)
+	case journalCreate:
+		return fmt.Sprintf("removed %s", e.target)
+	}
+	return fmt.Sprintf("%s -> %s", e.target, e.source)
+}
+
+// makeDirs creates a directory along with any necessary parents, and
+// returns directories created, parents first.
+func makeDirs(dir string) ([]string, error) {
+	missing := make([]string, 0, 2)
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		fi, err := os.Stat(d)
+		if err == nil {
+			if !fi.IsDir() {
+				return nil, fmt.Errorf("not a directory: %s", d)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		missing = append(missing, d)
+		if d == filepath.Dir(d) {
+			break
+		}
+	}
+
+	created := make([]string, 0, len(missing))
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil && !os.IsExist(err) {
+			return created, err
+		}
+		created = append(created, missing[i])
+	}
+	return created, nil
+}
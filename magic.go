@@ -0,0 +1,425 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var reMimeExt = regexp.MustCompile(`\{mimeext\}`)
+
+// fileType is a file format identified by magic bytes
+type fileType struct {
+	Name string
+	Exts []string // accepted extensions, the first one is the canonical one
+}
+
+// the built-in table of file types, keyed by short names
+var fileTypes = map[string]*fileType{
+	// images
+	"png":  {"PNG image", []string{".png"}},
+	"jpg":  {"JPEG image", []string{".jpg", ".jpeg", ".jpe", ".jfif"}},
+	"gif":  {"GIF image", []string{".gif"}},
+	"webp": {"WebP image", []string{".webp"}},
+	"tiff": {"TIFF image", []string{".tiff", ".tif"}},
+	"bmp":  {"BMP image", []string{".bmp", ".dib"}},
+	"ico":  {"ICO image", []string{".ico"}},
+	"heic": {"HEIF image", []string{".heic", ".heif"}},
+	"avif": {"AVIF image", []string{".avif"}},
+	"psd":  {"Photoshop document", []string{".psd"}},
+
+	// documents
+	"pdf":  {"PDF document", []string{".pdf"}},
+	"ps":   {"PostScript document", []string{".ps", ".eps"}},
+	"docx": {"Word document", []string{".docx", ".docm"}},
+	"xlsx": {"Excel workbook", []string{".xlsx", ".xlsm"}},
+	"pptx": {"PowerPoint presentation", []string{".pptx", ".pptm"}},
+	"epub": {"EPUB book", []string{".epub"}},
+	"ole":  {"OLE2 compound document", []string{".doc", ".xls", ".ppt", ".msi", ".msg"}},
+
+	// archives and compression formats
+	"zip":    {"ZIP archive", []string{".zip", ".jar", ".apk", ".whl", ".xpi", ".odt", ".ods", ".odp", ".kmz"}},
+	"tar":    {"tar archive", []string{".tar"}},
+	"targz":  {"gzip-compressed tar archive", []string{".tar.gz", ".tgz"}},
+	"7z":     {"7-Zip archive", []string{".7z"}},
+	"rar":    {"RAR archive", []string{".rar"}},
+	"gz":     {"gzip-compressed file", []string{".gz", ".gzip"}},
+	"bgz":    {"BGZF-compressed file", []string{".gz", ".bgz", ".bgzf"}},
+	"bz2":    {"bzip2-compressed file", []string{".bz2", ".tbz2", ".tbz"}},
+	"xz":     {"xz-compressed file", []string{".xz", ".txz"}},
+	"zst":    {"Zstandard-compressed file", []string{".zst", ".tzst"}},
+	"lz4":    {"LZ4-compressed file", []string{".lz4"}},
+	"sqlite": {"SQLite database", []string{".sqlite", ".sqlite3", ".db"}},
+	"hdf5":   {"HDF5 file", []string{".h5", ".hdf5", ".hdf", ".loom", ".h5ad"}},
+
+	// media
+	"mp4":  {"MP4 video", []string{".mp4", ".m4v", ".m4a", ".m4b", ".3gp", ".3g2"}},
+	"mov":  {"QuickTime video", []string{".mov", ".qt"}},
+	"mkv":  {"Matroska video", []string{".mkv", ".mka", ".mks"}},
+	"webm": {"WebM video", []string{".webm"}},
+	"avi":  {"AVI video", []string{".avi"}},
+	"wav":  {"WAV audio", []string{".wav"}},
+	"mp3":  {"MP3 audio", []string{".mp3"}},
+	"flac": {"FLAC audio", []string{".flac"}},
+	"ogg":  {"Ogg media", []string{".ogg", ".oga", ".ogv", ".opus"}},
+
+	// bioinformatics formats
+	"bam":     {"BAM alignments", []string{".bam"}},
+	"cram":    {"CRAM alignments", []string{".cram"}},
+	"bcf":     {"BCF variants", []string{".bcf"}},
+	"sam":     {"SAM alignments", []string{".sam"}},
+	"vcf":     {"VCF variants", []string{".vcf"}},
+	"vcfgz":   {"compressed VCF variants", []string{".vcf.gz", ".vcf.bgz"}},
+	"fastq":   {"FASTQ reads", []string{".fastq", ".fq"}},
+	"fastqgz": {"compressed FASTQ reads", []string{".fastq.gz", ".fq.gz"}},
+	"fasta":   {"FASTA sequences", []string{".fasta", ".fa", ".fna", ".faa", ".ffn", ".fas", ".fsa", ".mfa"}},
+	"fastagz": {"compressed FASTA sequences", []string{".fasta.gz", ".fa.gz", ".fna.gz", ".faa.gz", ".ffn.gz", ".fas.gz"}},
+	"gff":     {"GFF annotations", []string{".gff", ".gff3", ".gtf"}},
+	"gffgz":   {"compressed GFF annotations", []string{".gff.gz", ".gff3.gz", ".gtf.gz"}},
+	"tbi":     {"tabix index", []string{".tbi"}},
+}
+
+// knownExts contains all extensions in the table, longer ones first
+var knownExts []string
+
+func init() {
+	for _, t := range fileTypes {
+		knownExts = append(knownExts, t.Exts...)
+	}
+	sort.Slice(knownExts, func(i, j int) bool {
+		if len(knownExts[i]) == len(knownExts[j]) {
+			return knownExts[i] < knownExts[j]
+		}
+		return len(knownExts[i]) > len(knownExts[j])
+	})
+}
+
+// number of leading bytes to sniff
+const sniffSize = 4096
+
+// sniffFileType identifies the format of a file by its leading bytes.
+// Compressed files are further inspected by decompressing the leading
+// bytes, e.g., for gzipped FASTQ files and BAM files.
+func sniffFileType(file string) *fileType {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	buf := make([]byte, sniffSize)
+	n, _ := io.ReadFull(fh, buf)
+	buf = buf[:n]
+	if n == 0 {
+		return nil
+	}
+
+	if t := sniffBinary(buf); t != "" {
+		switch t {
+		case "gz":
+			if t = sniffGzip(fh); t == "gz" && isBGZF(buf) {
+				t = "bgz"
+			}
+		case "zip":
+			t = sniffZip(fh, fi.Size())
+		}
+		return fileTypes[t]
+	}
+	return fileTypes[sniffText(buf)]
+}
+
+func sniffBinary(b []byte) string {
+	has := func(offset int, sig string) bool {
+		return len(b) >= offset+len(sig) && string(b[offset:offset+len(sig)]) == sig
+	}
+	switch {
+	case has(0, "\x89PNG\r\n\x1a\n"):
+		return "png"
+	case has(0, "\xFF\xD8\xFF"):
+		return "jpg"
+	case has(0, "GIF87a"), has(0, "GIF89a"):
+		return "gif"
+	case has(0, "RIFF") && has(8, "WEBP"):
+		return "webp"
+	case has(0, "RIFF") && has(8, "WAVE"):
+		return "wav"
+	case has(0, "RIFF") && has(8, "AVI "):
+		return "avi"
+	case has(0, "II*\x00"), has(0, "MM\x00*"):
+		return "tiff"
+	case has(0, "BM") && len(b) >= 26 && b[14] >= 12:
+		return "bmp"
+	case has(0, "\x00\x00\x01\x00") && len(b) >= 6 && b[4] > 0:
+		return "ico"
+	case has(0, "8BPS"):
+		return "psd"
+	case has(4, "ftyp"):
+		return sniffFtyp(b)
+	case has(0, "\x1A\x45\xDF\xA3"):
+		head := b
+		if len(head) > 64 {
+			head = head[:64]
+		}
+		if bytes.Contains(head, []byte("webm")) {
+			return "webm"
+		}
+		return "mkv"
+	case has(0, "%PDF-"):
+		return "pdf"
+	case has(0, "%!PS"):
+		return "ps"
+	case has(0, "\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"):
+		return "ole"
+	case has(0, "PK\x03\x04"):
+		return "zip"
+	case has(257, "ustar"):
+		return "tar"
+	case has(0, "7z\xBC\xAF\x27\x1C"):
+		return "7z"
+	case has(0, "Rar!\x1A\x07"):
+		return "rar"
+	case has(0, "\x1F\x8B"):
+		return "gz"
+	case has(0, "BZh"):
+		return "bz2"
+	case has(0, "\xFD7zXZ\x00"):
+		return "xz"
+	case has(0, "\x28\xB5\x2F\xFD"):
+		return "zst"
+	case has(0, "\x04\x22\x4D\x18"):
+		return "lz4"
+	case has(0, "SQLite format 3\x00"):
+		return "sqlite"
+	case has(0, "\x89HDF\r\n\x1A\n"):
+		return "hdf5"
+	case has(0, "OggS"):
+		return "ogg"
+	case has(0, "fLaC"):
+		return "flac"
+	case has(0, "ID3"), len(b) >= 2 && b[0] == 0xFF && (b[1] == 0xFB || b[1] == 0xF3 || b[1] == 0xF2):
+		return "mp3"
+	case has(0, "CRAM"):
+		return "cram"
+	}
+	return ""
+}
+
+func sniffFtyp(b []byte) string {
+	if len(b) < 12 {
+		return "mp4"
+	}
+	switch string(b[8:12]) {
+	case "qt  ":
+		return "mov"
+	case "heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1":
+		return "heic"
+	case "avif", "avis":
+		return "avif"
+	}
+	return "mp4"
+}
+
+// sniffGzip decompresses the leading bytes of a gzip file
+func sniffGzip(r io.ReadSeeker) string {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "gz"
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "gz"
+	}
+	defer zr.Close()
+	zr.Multistream(true)
+
+	buf := make([]byte, sniffSize)
+	n, _ := io.ReadFull(zr, buf)
+	buf = buf[:n]
+
+	has := func(offset int, sig string) bool {
+		return len(buf) >= offset+len(sig) && string(buf[offset:offset+len(sig)]) == sig
+	}
+	switch {
+	case has(0, "BAM\x01"):
+		return "bam"
+	case has(0, "BCF\x02"):
+		return "bcf"
+	case has(0, "TBI\x01"):
+		return "tbi"
+	case has(257, "ustar"):
+		return "targz"
+	}
+	switch sniffText(buf) {
+	case "fastq":
+		return "fastqgz"
+	case "fasta":
+		return "fastagz"
+	case "vcf":
+		return "vcfgz"
+	case "gff":
+		return "gffgz"
+	}
+	return "gz"
+}
+
+// isBGZF checks if a gzip file is in the BGZF format used by BAM and
+// tabix, where the header has an extra subfield with identifiers "BC".
+func isBGZF(b []byte) bool {
+	if len(b) < 18 || b[3]&0x04 == 0 { // FLG.FEXTRA
+		return false
+	}
+	xlen := int(b[10]) | int(b[11])<<8
+	extra := b[12:]
+	if len(extra) > xlen {
+		extra = extra[:xlen]
+	}
+	for len(extra) >= 4 {
+		slen := int(extra[2]) | int(extra[3])<<8
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 {
+			return true
+		}
+		if len(extra) < 4+slen {
+			break
+		}
+		extra = extra[4+slen:]
+	}
+	return false
+}
+
+// sniffZip identifies formats based on ZIP, e.g., OOXML and EPUB
+func sniffZip(r io.ReaderAt, size int64) string {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return "zip"
+	}
+	for _, f := range zr.File {
+		switch f.Name {
+		case "word/document.xml":
+			return "docx"
+		case "xl/workbook.xml":
+			return "xlsx"
+		case "ppt/presentation.xml":
+			return "pptx"
+		case "mimetype":
+			if rc, err := f.Open(); err == nil {
+				b := make([]byte, 32)
+				n, _ := io.ReadFull(rc, b)
+				rc.Close()
+				if string(b[:n]) == "application/epub+zip" {
+					return "epub"
+				}
+			}
+		}
+	}
+	return "zip"
+}
+
+// sniffText identifies plain-text bioinformatics formats
+func sniffText(b []byte) string {
+	if len(b) == 0 || bytes.IndexByte(b, 0) >= 0 {
+		return ""
+	}
+	lines := strings.SplitN(string(b), "\n", 5)
+	switch {
+	case strings.HasPrefix(lines[0], "##fileformat=VCF"):
+		return "vcf"
+	case strings.HasPrefix(lines[0], "##gff-version"):
+		return "gff"
+	case strings.HasPrefix(lines[0], "@HD\t"), strings.HasPrefix(lines[0], "@SQ\t"):
+		return "sam"
+	case strings.HasPrefix(lines[0], "@") && len(lines) >= 4 && strings.HasPrefix(lines[2], "+"):
+		return "fastq"
+	case strings.HasPrefix(lines[0], ">") && len(lines) >= 2 && lines[1] != "" && lines[1][0] != '>':
+		return "fasta"
+	}
+	return ""
+}
+
+// hasExt checks if a file name ends with one of the extensions of a file type
+func hasExt(name string, t *fileType) bool {
+	name = strings.ToLower(name)
+	for _, ext := range t.Exts {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// reSimpleExt matches extensions which are replaced when fixing extensions
+var reSimpleExt = regexp.MustCompile(`^\.[A-Za-z0-9]{1,5}$`)
+
+// fixExt replaces the extension of a file name with the canonical one of
+// the file type. Known extensions in the table, including multi-part ones
+// like .tar.gz, are replaced as a whole.
+func fixExt(name string, t *fileType) string {
+	if hasExt(name, t) {
+		return name
+	}
+	lower := strings.ToLower(name)
+	stem := name
+	var found bool
+	for _, ext := range knownExts {
+		if len(ext) < len(name) && strings.HasSuffix(lower, ext) {
+			stem = name[:len(name)-len(ext)]
+			found = true
+			break
+		}
+	}
+	if !found {
+		if ext := extOf(name); reSimpleExt.MatchString(ext) {
+			stem = name[:len(name)-len(ext)]
+		}
+	}
+	return stem + t.Exts[0]
+}
+
+// extOf returns the extension of a file name, leading dots of hidden files
+// are not treated as extensions.
+func extOf(name string) string {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 {
+		return ""
+	}
+	return name[i:]
+}
+
+// replaceMimeExtPlaceholders fills {mimeext} in the replacement
+func replaceMimeExtPlaceholders(opt *Options, path string, r string) (string, bool) {
+	t := sniffFileType(path)
+	return replaceMetadata(opt, reMimeExt, r, func(m []string) (string, bool) {
+		if t == nil {
+			return "", false
+		}
+		return strings.TrimPrefix(t.Exts[0], "."), true
+	})
+}
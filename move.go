@@ -0,0 +1,177 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// files not smaller than this are copied with progress shown
+const copyProgressMinSize = 64 << 20
+
+// movableAcrossDevices checks if a path can be renamed to the target,
+// i.e., it is a regular file or a symbolic link, or the target is on the
+// same file system, where the nearest existing ancestor of the target is
+// checked for targets in directories not created yet.
+func movableAcrossDevices(path string, target string) bool {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode().IsRegular() || fi.Mode()&os.ModeSymlink != 0 {
+		return true
+	}
+	dev, ok := deviceID(fi)
+	if !ok {
+		return true
+	}
+	for d := filepath.Dir(target); ; d = filepath.Dir(d) {
+		if fi2, err := os.Stat(d); err == nil {
+			dev2, ok := deviceID(fi2)
+			return !ok || dev2 == dev
+		}
+		if d == filepath.Dir(d) {
+			return true
+		}
+	}
+}
+
+// moveAcrossDevices moves a path to another file system. The source is
+// copied like --action copy, and deleted only after the copy is verified.
+func moveAcrossDevices(source string, target string, verifyAlg string, progress bool) error {
+	if err := createPath(actionCopy, source, target, verifyAlg, progress); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+// copyFile copies data of a regular file, followed by file attributes
+func copyFile(source string, target string, fi os.FileInfo, progress bool) error {
+	r, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	var dst io.Writer = w
+	var pw *progressWriter
+	if progress && fi.Size() >= copyProgressMinSize {
+		pw = &progressWriter{w: w, name: filepath.Base(source), total: fi.Size()}
+		dst = pw
+	}
+	if _, err = io.Copy(dst, r); err != nil {
+		w.Close()
+		return err
+	}
+	if pw != nil {
+		pw.done()
+	}
+	if err = w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return copyAttrs(source, target, fi)
+}
+
+// copyAttrs copies permissions, extended attributes and timestamps
+func copyAttrs(source string, target string, fi os.FileInfo) error {
+	// the mode is set again as the umask applies to creating files
+	if err := os.Chmod(target, fi.Mode()); err != nil {
+		return err
+	}
+	if err := copyXattrs(source, target); err != nil {
+		return err
+	}
+	return os.Chtimes(target, fileAtime(fi), fi.ModTime())
+}
+
+// verifyCopy compares the size, and the digest if an algorithm is given
+func verifyCopy(source string, target string, fi os.FileInfo, alg string) error {
+	fi2, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	if fi2.Size() != fi.Size() {
+		return fmt.Errorf("size mismatch after copying: %d != %d", fi2.Size(), fi.Size())
+	}
+	if alg == "" {
+		return nil
+	}
+
+	d1, err := hashFile(source, []string{alg})
+	if err != nil {
+		return err
+	}
+	d2, err := hashFile(target, []string{alg})
+	if err != nil {
+		return err
+	}
+	if d1[alg] != d2[alg] {
+		return fmt.Errorf("%s mismatch after copying: %s != %s", alg, d2[alg], d1[alg])
+	}
+	return nil
+}
+
+func describeMode(fi os.FileInfo) string {
+	switch {
+	case fi.IsDir():
+		return "directory"
+	case fi.Mode()&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case fi.Mode()&os.ModeSocket != 0:
+		return "socket"
+	case fi.Mode()&os.ModeDevice != 0:
+		return "device"
+	}
+	return "special file"
+}
+
+// progressWriter shows the progress of copying a big file
+type progressWriter struct {
+	w     io.Writer
+	name  string
+	total int64
+	n     int64
+	last  time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if time.Since(p.last) >= 500*time.Millisecond {
+		p.last = time.Now()
+		fmt.Fprintf(os.Stderr, "\r  %-78s", fmt.Sprintf("copying %s: %.1f%%", p.name, float64(p.n)*100/float64(p.total)))
+	}
+	return n, err
+}
+
+func (p *progressWriter) done() {
+	fmt.Fprintf(os.Stderr, "\r  %-78s\r", "")
+}
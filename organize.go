@@ -0,0 +1,109 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var reMtime = regexp.MustCompile(`\{mtime(?::([^{}]+))?\}`)
+var reExif = regexp.MustCompile(`\{exif:(\w+)(?::([^{}]+))?\}`)
+
+// default time layout of {mtime}
+var mtimeLayout = "20060102_150405"
+
+// names of EXIF tags supported by {exif:NAME}
+var exifTagNames = map[string]uint16{
+	"Make":             0x010F,
+	"Model":            0x0110,
+	"Software":         0x0131,
+	"DateTime":         exifTagDateTime,
+	"Artist":           0x013B,
+	"DateTimeOriginal": exifTagDateTimeOriginal,
+	"LensMake":         0xA433,
+	"LensModel":        0xA434,
+}
+
+// replaceMtimePlaceholders fills {mtime} and {mtime:LAYOUT} in the replacement
+func replaceMtimePlaceholders(opt *Options, path string, r string) (string, bool) {
+	fi, err := os.Lstat(path)
+	return replaceMetadata(opt, reMtime, r, func(m []string) (string, bool) {
+		if err != nil {
+			return "", false
+		}
+		layout := m[1]
+		if layout == "" {
+			layout = mtimeLayout
+		}
+		return fi.ModTime().Format(layout), true
+	})
+}
+
+// replaceExifPlaceholders fills {exif:NAME} in the replacement. A time
+// layout can be given for dates, e.g., {exif:DateTimeOriginal:2006}.
+func replaceExifPlaceholders(opt *Options, path string, r string) (string, bool) {
+	info, err := readImageInfo(path)
+	return replaceMetadata(opt, reExif, r, func(m []string) (string, bool) {
+		if err != nil {
+			return "", false
+		}
+		v, ok := info.Exif[exifTagNames[m[1]]]
+		v = strings.TrimSpace(v)
+		if !ok || v == "" {
+			return "", false
+		}
+		if m[2] != "" {
+			t, err := time.ParseInLocation(exifTimeLayout, v, time.Local)
+			if err != nil {
+				return "", false
+			}
+			return t.Format(m[2]), true
+		}
+		return v, true
+	})
+}
+
+// organizeDir returns the directory, relative to the search root, built
+// from the template of --organize. Placeholders and capture variables of
+// the first matched rule are supported.
+func organizeDir(opt *Options, root string, path string, filename string, nrValues map[string]string) (string, code) {
+	ru := matchedRule(opt, root, path, filename)
+	if ru == nil {
+		return "", codeUnchanged
+	}
+	tmpl := *ru
+	tmpl.replacement = opt.Organize
+	r, c := fillReplacement(opt, &tmpl, path, filename, nrValues)
+	if c != codeOK {
+		return "", c
+	}
+
+	loc := ru.re.FindStringSubmatchIndex(filename)
+	dir := string(ru.re.ExpandString(nil, r, filename, loc))
+	if reCaseConv.MatchString(dir) {
+		dir = convertCase(dir)
+	}
+	return filepath.Clean(filepath.FromSlash(dir)), codeOK
+}
@@ -0,0 +1,169 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var reRandom = regexp.MustCompile(`\{(uuid(?::v[47])?|ulid|rand:(\d+))\}`)
+
+// source of random bytes, crypto/rand by default, or a seeded
+// math/rand generator when --seed given.
+var idRand io.Reader = crand.Reader
+
+// setRandomSeed makes generated IDs reproducible
+func setRandomSeed(seed int64) {
+	idRand = rand.New(rand.NewSource(seed))
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(idRand, buf); err != nil {
+		checkError(fmt.Errorf("failed to generate random bytes: %s", err))
+	}
+	return buf
+}
+
+// newUUIDv4 returns a random UUID (RFC 9562, version 4)
+func newUUIDv4() string {
+	u := randomBytes(16)
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u)
+}
+
+// newUUIDv7 returns a time-ordered UUID (RFC 9562, version 7)
+func newUUIDv7(t time.Time) string {
+	u := randomBytes(16)
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	u[0], u[1], u[2] = byte(ms>>40), byte(ms>>32), byte(ms>>24)
+	u[3], u[4], u[5] = byte(ms>>16), byte(ms>>8), byte(ms)
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u)
+}
+
+func formatUUID(u []byte) string {
+	s := hex.EncodeToString(u)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+// Crockford's base32 used by ULID
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48-bit timestamp in milliseconds and 80 random bits,
+// encoded in 26 characters of Crockford's base32.
+func newULID(t time.Time) string {
+	var u [16]byte
+	binary.BigEndian.PutUint64(u[0:8], uint64(t.UnixNano()/int64(time.Millisecond))<<16)
+	copy(u[6:], randomBytes(10))
+
+	// 128 bits -> 26 characters, the first one carries only 3 bits
+	var hi, lo = binary.BigEndian.Uint64(u[0:8]), binary.BigEndian.Uint64(u[8:16])
+	buf := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(buf)
+}
+
+const randChars = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// newRandString returns a random string of digits and lowercase letters
+func newRandString(n int) string {
+	buf := make([]byte, 0, n)
+	for len(buf) < n {
+		for _, b := range randomBytes(n) {
+			if b >= 252 { // 252 = 36 * 7, avoiding modulo bias
+				continue
+			}
+			buf = append(buf, randChars[b%36])
+			if len(buf) == n {
+				break
+			}
+		}
+	}
+	return string(buf)
+}
+
+// replaceRandomPlaceholders fills {uuid}, {uuid:v7}, {ulid} and {rand:N}
+// in the replacement. Identical placeholders share the same value.
+// Timestamps of {uuid:v7} and {ulid} come from the modification time of
+// the file when --seed given, so that the results are reproducible.
+func replaceRandomPlaceholders(opt *Options, path string, r string) string {
+	t := time.Now()
+	if opt.SeedSet {
+		if fi, err := os.Lstat(path); err == nil {
+			t = fi.ModTime()
+		}
+	}
+
+	values := make(map[string]string, 1)
+	return reRandom.ReplaceAllStringFunc(r, func(s string) string {
+		if v, ok := values[s]; ok {
+			return v
+		}
+		m := reRandom.FindStringSubmatch(s)
+		var v string
+		switch m[1] {
+		case "uuid", "uuid:v4":
+			v = newUUIDv4()
+		case "uuid:v7":
+			v = newUUIDv7(t)
+		case "ulid":
+			v = newULID(t)
+		default:
+			n, _ := strconv.Atoi(m[2])
+			v = newRandString(n)
+		}
+		values[s] = v
+		return v
+	})
+}
+
+// exportKV writes the new and original paths of a renamed path, relative to
+// the search root, into a tab-delimited key-value file, which can be used to
+// rename them back with brename -R -P -p "(.+)" -r "{kv}" -k FILE ROOT.
+func exportKV(w io.Writer, root string, op operation) error {
+	target, err := filepath.Rel(root, op.target)
+	if err != nil {
+		return err
+	}
+	source, err := filepath.Rel(root, op.source)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\t%s\n", filepath.ToSlash(target), filepath.ToSlash(source))
+	return err
+}
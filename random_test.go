@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// buildBrename builds the binary into a temporary directory.
+func buildBrename(t *testing.T) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), "brename")
+	out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput()
+	if err != nil {
+		t.Fatalf("build: %s\n%s", err, out)
+	}
+	return bin
+}
+
+// listFiles returns paths of files under root, relative to root.
+func listFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestExportKVRoundTrip(t *testing.T) {
+	bin := buildBrename(t)
+
+	work := t.TempDir()
+	dir := filepath.Join(work, "dir")
+	files := []string{"a.txt", "b.fq.gz", "sub/c.txt"}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command(bin, append([]string{"-q"}, args...)...)
+		cmd.Dir = work
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("brename %v: %s\n%s", args, err, out)
+		}
+	}
+
+	run("-p", ".+", "-r", "{rand:12}", "-e", "-R", "--seed", "1", "--export-kv", "map.tsv", "dir")
+	renamed := listFiles(t, dir)
+	for _, file := range files {
+		for _, r := range renamed {
+			if r == file {
+				t.Fatalf("%s is not renamed", file)
+			}
+		}
+	}
+
+	run("-R", "-P", "-p", "(.+)", "-r", "{kv}", "-k", "map.tsv", "dir")
+	restored := listFiles(t, dir)
+	if len(restored) != len(files) {
+		t.Fatalf("restored %v, want %v", restored, files)
+	}
+	for i := range files {
+		if restored[i] != files[i] {
+			t.Fatalf("restored %v, want %v", restored, files)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// rule is a pair of search pattern and replacement. Rules are applied
+// in order to each file name, the output of a rule is the input of the next.
+type rule struct {
+	pattern     string
+	re          *regexp.Regexp
+	replacement string
+	global      bool // replacing all matches, or only the first one
+	occurrence  int  // only replacing the Nth match, negative values count from the end
+	limit       int  // maximum number of matches to replace, 0 for no limit
+
+	guards []*guard // all guards should be satisfied to apply the rule
+
+	// branches of an if-then-else statement, only the first branch with
+	// guards satisfied is applied.
+	branches []*rule
+}
+
+// newRule compiles the pattern of a rule
+func newRule(pattern string, replacement string, ignoreCase bool, global bool) (*rule, error) {
+	p := pattern
+	if ignoreCase {
+		p = "(?i)" + p
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil, fmt.Errorf("illegal regular expression for search pattern: %s", pattern)
+	}
+	return &rule{pattern: pattern, re: re, replacement: replacement, global: global}, nil
+}
+
+// replace replaces matches of the rule in name with r, the replacement
+// with placeholders filled.
+func (ru *rule) replace(name string, r string) string {
+	locs := ru.selectMatches(name)
+	if len(locs) == 0 {
+		return name
+	}
+	convert := reCaseConv.MatchString(r)
+	buf := make([]byte, 0, len(name)+len(r))
+	var i int
+	for _, loc := range locs {
+		buf = append(buf, name[i:loc[0]]...)
+		if convert {
+			buf = append(buf, convertCase(string(ru.re.ExpandString(nil, r, name, loc)))...)
+		} else {
+			buf = ru.re.ExpandString(buf, r, name, loc)
+		}
+		i = loc[1]
+	}
+	buf = append(buf, name[i:]...)
+	return string(buf)
+}
+
+// selectMatches returns locations of matches to replace. Matches start
+// from the Nth one if an occurrence is given, then only one match is
+// selected unless the rule is global or has a limit.
+func (ru *rule) selectMatches(name string) [][]int {
+	n := -1
+	if ru.occurrence == 0 && ru.limit == 0 && !ru.global {
+		n = 1
+	} else if ru.occurrence >= 0 && ru.limit > 0 {
+		n = ru.occurrence + ru.limit
+	}
+	locs := ru.re.FindAllStringSubmatchIndex(name, n)
+
+	if ru.occurrence > 0 {
+		if ru.occurrence > len(locs) {
+			return nil
+		}
+		locs = locs[ru.occurrence-1:]
+	} else if ru.occurrence < 0 {
+		if -ru.occurrence > len(locs) {
+			return nil
+		}
+		locs = locs[len(locs)+ru.occurrence:]
+	}
+
+	if ru.limit > 0 {
+		if ru.limit < len(locs) {
+			locs = locs[:ru.limit]
+		}
+	} else if !ru.global && len(locs) > 1 {
+		locs = locs[:1]
+	}
+	return locs
+}
+
+// case conversion escapes like GNU sed: \L and \U convert the following
+// text to lowercase and uppercase, until \E or the end of the replacement.
+var reCaseConv = regexp.MustCompile(`\\[LUE]`)
+
+func convertCase(s string) string {
+	locs := reCaseConv.FindAllStringIndex(s, -1)
+	var sb strings.Builder
+	var i int
+	var mode byte = 'E'
+	write := func(t string) {
+		switch mode {
+		case 'L':
+			t = strings.ToLower(t)
+		case 'U':
+			t = strings.ToUpper(t)
+		}
+		sb.WriteString(t)
+	}
+	for _, loc := range locs {
+		write(s[i:loc[0]])
+		mode = s[loc[0]+1]
+		i = loc[1]
+	}
+	write(s[i:])
+	return sb.String()
+}
+
+// leaves returns the rule, or all rules in branches of an if-then-else
+// statement, which have search patterns.
+func (ru *rule) leaves() []*rule {
+	if len(ru.branches) == 0 {
+		return []*rule{ru}
+	}
+	rules := make([]*rule, 0, len(ru.branches))
+	for _, b := range ru.branches {
+		rules = append(rules, b.leaves()...)
+	}
+	return rules
+}
+
+// resolve returns the rule to apply to a file name, or nil if none.
+// For if-then-else statements, the branch is chosen by guards only.
+func (ru *rule) resolve(opt *Options, root string, path string, name string) *rule {
+	if len(ru.branches) > 0 {
+		for _, b := range ru.branches {
+			if checkGuards(b.guards, root, path, name) {
+				return b.resolve(opt, root, path, name)
+			}
+		}
+		return nil
+	}
+	if !checkGuards(ru.guards, root, path, name) || !ru.re.MatchString(name) {
+		return nil
+	}
+	return ru
+}
+
+// matchedRule returns the first rule applicable to the name, or nil if none.
+// Since rules only change names they match, a path is renamed only if
+// at least one rule matches the original name.
+func matchedRule(opt *Options, root string, path string, name string) *rule {
+	if !checkGuards(opt.Guards, root, path, name) {
+		return nil
+	}
+	for _, ru := range opt.Rules {
+		if r := ru.resolve(opt, root, path, name); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// parseScript reads rules from a script file. Each line is a substitution
+// command like sed:
+//
+//	s/PATTERN/REPLACEMENT/FLAGS
+//
+// Any character can be used as the delimiter after "s", and it can be escaped
+// by a backslash in the pattern and the replacement. Flags: g for replacing all
+// matches (default: only the first one), i for ignoring case, and a number N
+// for only replacing the Nth match, or the Nth and following ones with g.
+//
+// Or a conditional statement with guards (see parseGuard):
+//
+//	if GUARD then COMMAND [else if GUARD then COMMAND]... [else COMMAND]
+//
+// Blank lines and lines starting with "#" are ignored.
+func parseScript(file string, ignoreCase bool) ([]*rule, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	rules := make([]*rule, 0, 8)
+	scanner := bufio.NewScanner(fh)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		ru, rest, err := parseStatement(line, ignoreCase)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = fmt.Errorf("unexpected text: %s", rest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		rules = append(rules, ru)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no rules found in script file: %s", file)
+	}
+	return rules, nil
+}
+
+// parseStatement parses a substitution command or an if-then-else
+// statement, and returns the remaining text.
+func parseStatement(s string, ignoreCase bool) (*rule, string, error) {
+	s = strings.TrimSpace(s)
+	if !hasKeyword(s, "if") {
+		return parseSubstitution(s, ignoreCase)
+	}
+
+	ru := &rule{branches: make([]*rule, 0, 2)}
+	for {
+		var g *guard
+		var b *rule
+		var err error
+		if g, s, err = parseGuard(strings.TrimSpace(s[2:]), ignoreCase); err != nil {
+			return nil, "", err
+		}
+		s = strings.TrimSpace(s)
+		if !hasKeyword(s, "then") {
+			return nil, "", fmt.Errorf(`"then" expected: %s`, s)
+		}
+		if b, s, err = parseSubstitution(strings.TrimSpace(s[4:]), ignoreCase); err != nil {
+			return nil, "", err
+		}
+		b.guards = []*guard{g}
+		ru.branches = append(ru.branches, b)
+
+		s = strings.TrimSpace(s)
+		if !hasKeyword(s, "else") {
+			return ru, s, nil
+		}
+		s = strings.TrimSpace(s[4:])
+		if hasKeyword(s, "if") {
+			continue
+		}
+		if b, s, err = parseSubstitution(s, ignoreCase); err != nil {
+			return nil, "", err
+		}
+		ru.branches = append(ru.branches, b)
+		return ru, s, nil
+	}
+}
+
+// hasKeyword checks if s starts with the keyword followed by a space
+func hasKeyword(s string, kw string) bool {
+	return strings.HasPrefix(s, kw) && len(s) > len(kw) && (s[len(kw)] == ' ' || s[len(kw)] == '\t')
+}
+
+// readDelimited reads text ending with the unescaped delimiter,
+// escaped delimiters are unescaped.
+func readDelimited(s string, delim byte) (string, string, bool) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == delim {
+			sb.WriteByte(delim)
+			i++
+			continue
+		}
+		if s[i] == delim {
+			return sb.String(), s[i+1:], true
+		}
+		sb.WriteByte(s[i])
+	}
+	return "", "", false
+}
+
+// parseSubstitution parses a command of s/PATTERN/REPLACEMENT/FLAGS,
+// and returns the remaining text.
+func parseSubstitution(cmd string, ignoreCase bool) (*rule, string, error) {
+	if len(cmd) < 4 || cmd[0] != 's' {
+		return nil, "", fmt.Errorf("invalid substitution command: %s", cmd)
+	}
+	delim := cmd[1]
+	if delim == '\\' || delim == ' ' {
+		return nil, "", fmt.Errorf("invalid delimiter in substitution command: %s", cmd)
+	}
+
+	pattern, s, ok := readDelimited(cmd[2:], delim)
+	if !ok {
+		return nil, "", fmt.Errorf("incomplete substitution command: %s", cmd)
+	}
+	replacement, s, ok := readDelimited(s, delim)
+	if !ok {
+		return nil, "", fmt.Errorf("incomplete substitution command: %s", cmd)
+	}
+
+	var global bool
+	var occurrence int
+	var i int
+	for ; i < len(s) && s[i] != ' ' && s[i] != '\t'; i++ {
+		switch c := s[i]; {
+		case c == 'g':
+			global = true
+		case c == 'i':
+			ignoreCase = true
+		case c >= '0' && c <= '9':
+			occurrence = occurrence*10 + int(c-'0')
+		default:
+			return nil, "", fmt.Errorf("unknown flag in substitution command: %c", s[i])
+		}
+	}
+	if pattern == "" {
+		return nil, "", fmt.Errorf("empty pattern in substitution command: %s", cmd)
+	}
+	if strings.Contains(s[:i], "0") && occurrence == 0 {
+		return nil, "", fmt.Errorf("the number flag in substitution command should be positive: %s", cmd)
+	}
+	ru, err := newRule(pattern, replacement, ignoreCase, global)
+	if err == nil {
+		ru.occurrence = occurrence
+	}
+	return ru, s[i:], err
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestReplaceWithoutCaseEscapes(t *testing.T) {
+	// replacements without \L, \U and \E are expanded as before
+	cases := []struct {
+		pattern, replacement, name string
+	}{
+		{`_`, `-`, `a_b_c.txt`},
+		{`(\w+)_(\d)`, `${1}.R${2}`, `reads_1.fq`},
+		{`\.txt$`, `\l\u\e\1.md`, `a.txt`},
+		{`^`, `D:\data\`, `a.txt`},
+		{`.+`, `${0}`, `a\Ub\L.txt`},
+	}
+	for _, c := range cases {
+		ru, err := newRule(c.pattern, c.replacement, false, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ru.re.ReplaceAllString(c.name, c.replacement)
+		if got := ru.replace(c.name, c.replacement); got != want {
+			t.Errorf("-p '%s' -r '%s' on %s: got %s, want %s", c.pattern, c.replacement, c.name, got, want)
+		}
+	}
+}
+
+func TestReplaceWithCaseEscapes(t *testing.T) {
+	ru, err := newRule(`(\w)(\w*)`, `\U${1}\L${2}`, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ru.replace("hELLO wORLD", ru.replacement), "Hello World"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// numbers of descendant paths of directories renamed in the mode of --segments
+var segmentDescendants = make(map[string]int)
+
+// segmentCandidates keeps directories under the search paths, the search
+// paths themselves are not renamed. Directories are in the bottom-up
+// order, so deeper components are renamed before their ancestors, and
+// operations of all components only use the original paths of parents.
+func segmentCandidates(candidates []candidate, paths []string) []candidate {
+	roots := make(map[string]struct{}, len(paths))
+	for _, path := range paths {
+		roots[filepath.Clean(path)] = struct{}{}
+	}
+	_candidates := make([]candidate, 0, len(candidates))
+	for _, c := range candidates {
+		if _, ok := roots[filepath.Clean(c.path)]; ok {
+			continue
+		}
+		_candidates = append(_candidates, c)
+	}
+	return _candidates
+}
+
+// countDescendants counts all paths under a directory
+func countDescendants(dir string) int {
+	var n int
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != dir {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// planSegments records numbers of descendants of directories to rename,
+// and returns the number of affected descendant paths, where paths under
+// multiple renamed directories are counted once.
+func planSegments(ops []operation) int {
+	renamed := make(map[string]struct{}, len(ops))
+	for _, op := range ops {
+		if op.code == codeOK {
+			renamed[op.source] = struct{}{}
+		}
+	}
+
+	var n int
+	for _, op := range ops {
+		if op.code != codeOK {
+			continue
+		}
+		c := countDescendants(op.source)
+		segmentDescendants[op.source] = c
+
+		var nested bool
+		for dir := filepath.Dir(op.source); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if _, ok := renamed[dir]; ok {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			n += c
+		}
+	}
+	return n
+}
@@ -0,0 +1,175 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shenwei356/natsort"
+)
+
+const (
+	exifTagDateTime           = 0x0132
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTime         = 0x9010
+	exifTagOffsetTimeOriginal = 0x9011
+)
+
+// time layout of EXIF dates
+var exifTimeLayout = "2006:01:02 15:04:05"
+
+// parseSortBy checks the value of --sort-by, and returns the sorting key
+// and the seed for random order.
+func parseSortBy(s string) (string, int64, error) {
+	key, value := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		key, value = s[:i], s[i+1:]
+	}
+	switch key {
+	case "", "name", "natural", "mtime", "size", "exif":
+		if value != "" {
+			return "", 0, fmt.Errorf("invalid value of flag --sort-by: %s", s)
+		}
+		return key, 0, nil
+	case "random":
+		if value == "" {
+			return key, time.Now().UnixNano(), nil
+		}
+		seed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid seed in flag --sort-by: %s", s)
+		}
+		return key, seed, nil
+	}
+	return "", 0, fmt.Errorf("invalid value of flag --sort-by: %s, available: name, natural, mtime, size, exif, random:SEED", s)
+}
+
+// captureTime returns the EXIF DateTimeOriginal of images, the creation
+// time of videos, or the modification time for other files. Times are
+// normalized to UTC, as creation times of MP4 and Matroska are in UTC.
+func captureTime(path string, fi os.FileInfo) time.Time {
+	if info, err := readImageInfo(path); err == nil {
+		for _, tags := range [][2]uint16{
+			{exifTagDateTimeOriginal, exifTagOffsetTimeOriginal},
+			{exifTagDateTime, exifTagOffsetTime},
+		} {
+			if v, ok := info.Exif[tags[0]]; ok {
+				if t, err := parseExifTime(v, info.Exif[tags[1]]); err == nil {
+					return t.UTC()
+				}
+			}
+		}
+	} else if info, err := readVideoInfo(path); err == nil && !info.Created.IsZero() {
+		return info.Created.UTC()
+	}
+	if fi == nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// parseExifTime parses an EXIF date with the offset from UTC in the tag
+// OffsetTime*, e.g., "+08:00". EXIF dates are recorded in the local time
+// of the camera, so dates without offsets are taken as local times.
+func parseExifTime(v string, offset string) (time.Time, error) {
+	if offset != "" {
+		if t, err := time.Parse(exifTimeLayout+"-07:00", v+offset); err == nil {
+			return t, nil
+		}
+	}
+	return time.ParseInLocation(exifTimeLayout, v, time.Local)
+}
+
+// planOrder returns the order of candidates for assigning numbers of {nr}.
+// The renaming order is not affected, so that paths in a directory are
+// always renamed before the directory itself.
+func planOrder(opt *Options, candidates []candidate) []int {
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	if opt.SortBy == "" {
+		if opt.SortReverse {
+			reverseInts(order)
+		}
+		return order
+	}
+
+	if opt.SortBy == "random" {
+		r := rand.New(rand.NewSource(opt.SortSeed))
+		r.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		return order
+	}
+
+	names := make([]string, len(candidates))
+	sizes := make([]int64, len(candidates))
+	times := make([]time.Time, len(candidates))
+	for i, c := range candidates {
+		names[i] = filepath.Base(c.path)
+		switch opt.SortBy {
+		case "mtime", "size", "exif":
+			fi, err := os.Stat(c.path)
+			if err != nil {
+				continue
+			}
+			sizes[i] = fi.Size()
+			if opt.SortBy == "exif" {
+				times[i] = captureTime(c.path, fi)
+			} else {
+				times[i] = fi.ModTime()
+			}
+		}
+	}
+
+	var less func(a, b int) bool
+	switch opt.SortBy {
+	case "name":
+		less = func(a, b int) bool { return names[a] < names[b] }
+	case "natural":
+		less = func(a, b int) bool { return natsort.Compare(names[a], names[b], false) }
+	case "mtime", "exif":
+		less = func(a, b int) bool { return times[a].Before(times[b]) }
+	case "size":
+		less = func(a, b int) bool { return sizes[a] < sizes[b] }
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if opt.SortReverse {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+	return order
+}
+
+func reverseInts(s []int) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
@@ -0,0 +1,537 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var reVideo = regexp.MustCompile(`\{video:(created|duration|width|height)(:[^{}]+)?\}`)
+
+// default time layout for {video:created}
+var videoTimeLayout = "20060102_150405"
+
+// videoInfo contains metadata parsed from the headers of a video container
+type videoInfo struct {
+	Created  time.Time
+	Duration time.Duration
+	Width    int
+	Height   int
+}
+
+var errUnsupportedVideo = errors.New("unsupported video container")
+
+// maximum size of a moov box or a Matroska Info/Tracks element to load
+const maxVideoHeaderSize = 64 << 20
+
+// readVideoInfo reads metadata from the headers of MP4/MOV or Matroska/WebM
+// files. Only container headers are read, streams are never decoded.
+func readVideoInfo(file string) (*videoInfo, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, errUnsupportedVideo
+	}
+
+	var magic [8]byte
+	if _, err = io.ReadFull(fh, magic[:]); err != nil {
+		return nil, errUnsupportedVideo
+	}
+	if _, err = fh.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(magic[:4], []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		return readMatroskaInfo(fh)
+	}
+	switch string(magic[4:8]) {
+	case "ftyp", "moov", "mdat", "free", "skip", "wide", "pnot":
+		return readMP4Info(fh, fi.Size())
+	}
+	return nil, errUnsupportedVideo
+}
+
+// ------------------------------------------------------------------------
+// MP4/MOV (ISO base media file format)
+
+// seconds between 1904-01-01 and 1970-01-01
+const mp4EpochOffset = 2082844800
+
+// readMP4Info seeks over top-level boxes until the moov box is found,
+// which might locate after the mdat box.
+func readMP4Info(r io.ReadSeeker, size int64) (*videoInfo, error) {
+	var offset int64
+	var hdr [16]byte
+	var boxSize, hdrSize int64
+	for offset+8 <= size {
+		if _, err := r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, hdr[:8]); err != nil {
+			return nil, err
+		}
+		boxSize = int64(binary.BigEndian.Uint32(hdr[:4]))
+		hdrSize = 8
+		switch boxSize {
+		case 0: // box extends to the end of file
+			boxSize = size - offset
+		case 1: // 64-bit largesize
+			if _, err := io.ReadFull(r, hdr[8:16]); err != nil {
+				return nil, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			hdrSize = 16
+		}
+		if boxSize < hdrSize {
+			return nil, fmt.Errorf("invalid MP4 box size: %d", boxSize)
+		}
+
+		if string(hdr[4:8]) == "moov" {
+			if boxSize-hdrSize > maxVideoHeaderSize {
+				return nil, fmt.Errorf("MP4 moov box too big: %d", boxSize)
+			}
+			buf := make([]byte, boxSize-hdrSize)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			return parseMP4Moov(buf)
+		}
+
+		offset += boxSize
+	}
+	return nil, errors.New("MP4 moov box not found")
+}
+
+// mp4Boxes iterates child boxes in data
+func mp4Boxes(data []byte, fn func(typ string, body []byte) error) error {
+	var boxSize, hdrSize uint64
+	for len(data) >= 8 {
+		boxSize = uint64(binary.BigEndian.Uint32(data[:4]))
+		hdrSize = 8
+		switch boxSize {
+		case 0:
+			boxSize = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return errors.New("truncated MP4 box")
+			}
+			boxSize = binary.BigEndian.Uint64(data[8:16])
+			hdrSize = 16
+		}
+		if boxSize < hdrSize || boxSize > uint64(len(data)) {
+			return errors.New("invalid MP4 box size")
+		}
+		if err := fn(string(data[4:8]), data[hdrSize:boxSize]); err != nil {
+			return err
+		}
+		data = data[boxSize:]
+	}
+	return nil
+}
+
+func parseMP4Moov(moov []byte) (*videoInfo, error) {
+	info := &videoInfo{}
+	var foundMvhd bool
+
+	err := mp4Boxes(moov, func(typ string, body []byte) error {
+		switch typ {
+		case "mvhd":
+			var created, timescale, duration uint64
+			if len(body) < 1 {
+				return errors.New("truncated MP4 mvhd box")
+			}
+			if body[0] == 1 {
+				if len(body) < 32 {
+					return errors.New("truncated MP4 mvhd box")
+				}
+				created = binary.BigEndian.Uint64(body[4:12])
+				timescale = uint64(binary.BigEndian.Uint32(body[20:24]))
+				duration = binary.BigEndian.Uint64(body[24:32])
+			} else {
+				if len(body) < 20 {
+					return errors.New("truncated MP4 mvhd box")
+				}
+				created = uint64(binary.BigEndian.Uint32(body[4:8]))
+				timescale = uint64(binary.BigEndian.Uint32(body[12:16]))
+				duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+			}
+			if created > mp4EpochOffset {
+				info.Created = time.Unix(int64(created-mp4EpochOffset), 0).UTC()
+			}
+			if timescale > 0 && duration != math.MaxUint32 && duration != math.MaxUint64 {
+				info.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+			}
+			foundMvhd = true
+		case "trak":
+			if info.Width > 0 {
+				return nil
+			}
+			w, h, ok := parseMP4Trak(body)
+			if ok {
+				info.Width, info.Height = w, h
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !foundMvhd {
+		return nil, errors.New("MP4 mvhd box not found")
+	}
+	return info, nil
+}
+
+// parseMP4Trak returns the display size of a video track
+func parseMP4Trak(trak []byte) (int, int, bool) {
+	var tkhd []byte
+	var handler string
+	mp4Boxes(trak, func(typ string, body []byte) error {
+		switch typ {
+		case "tkhd":
+			tkhd = body
+		case "mdia":
+			mp4Boxes(body, func(typ string, body []byte) error {
+				if typ == "hdlr" && len(body) >= 12 {
+					handler = string(body[8:12])
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if handler != "vide" || len(tkhd) < 1 {
+		return 0, 0, false
+	}
+
+	// offsets of the transformation matrix and the width
+	matrix, size := 40, 76
+	if tkhd[0] == 1 {
+		matrix, size = 52, 88
+	}
+	if len(tkhd) < size+8 {
+		return 0, 0, false
+	}
+	w := int(binary.BigEndian.Uint32(tkhd[size:size+4]) >> 16)
+	h := int(binary.BigEndian.Uint32(tkhd[size+4:size+8]) >> 16)
+
+	// rotated by 90 or 270 degrees
+	a := int32(binary.BigEndian.Uint32(tkhd[matrix : matrix+4]))
+	b := int32(binary.BigEndian.Uint32(tkhd[matrix+4 : matrix+8]))
+	if a == 0 && b != 0 {
+		w, h = h, w
+	}
+	return w, h, w > 0 && h > 0
+}
+
+// ------------------------------------------------------------------------
+// Matroska/WebM (EBML)
+
+const (
+	ebmlIDHeader        = 0x1A45DFA3
+	ebmlIDSegment       = 0x18538067
+	ebmlIDInfo          = 0x1549A966
+	ebmlIDTracks        = 0x1654AE6B
+	ebmlIDCluster       = 0x1F43B675
+	ebmlIDTimecodeScale = 0x2AD7B1
+	ebmlIDDuration      = 0x4489
+	ebmlIDDateUTC       = 0x4461
+	ebmlIDTrackEntry    = 0xAE
+	ebmlIDTrackType     = 0x83
+	ebmlIDVideo         = 0xE0
+	ebmlIDPixelWidth    = 0xB0
+	ebmlIDPixelHeight   = 0xBA
+)
+
+const ebmlUnknownSize = math.MaxUint64
+
+// 2001-01-01T00:00:00 UTC, the epoch of DateUTC
+var matroskaEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func readByte(r io.Reader) (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// readEBMLVint reads a variable-length integer. The length marker is kept
+// for element IDs and removed for element sizes.
+func readEBMLVint(r io.Reader, keepMarker bool) (uint64, error) {
+	first, err := readByte(r)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for n = 1; n <= 8; n++ {
+		if first&(0x80>>uint(n-1)) != 0 {
+			break
+		}
+	}
+	if n > 8 {
+		return 0, errors.New("invalid EBML variable-length integer")
+	}
+
+	v := uint64(first)
+	allOnes := first&(0xFF>>uint(n)) == 0xFF>>uint(n)
+	if !keepMarker {
+		v &= uint64(0xFF >> uint(n))
+	}
+	var b byte
+	for i := 1; i < n; i++ {
+		if b, err = readByte(r); err != nil {
+			return 0, err
+		}
+		if b != 0xFF {
+			allOnes = false
+		}
+		v = v<<8 | uint64(b)
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknownSize, nil
+	}
+	return v, nil
+}
+
+func readEBMLHeader(r io.Reader) (id uint64, size uint64, err error) {
+	if id, err = readEBMLVint(r, true); err != nil {
+		return
+	}
+	size, err = readEBMLVint(r, false)
+	return
+}
+
+func ebmlUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return 0
+}
+
+// ebmlElements iterates child elements of a master element loaded in memory
+func ebmlElements(data []byte, fn func(id uint64, body []byte)) error {
+	r := bytes.NewReader(data)
+	var id, size uint64
+	var err error
+	for r.Len() > 0 {
+		if id, size, err = readEBMLHeader(r); err != nil {
+			return err
+		}
+		if size == ebmlUnknownSize || size > uint64(r.Len()) {
+			size = uint64(r.Len())
+		}
+		start := len(data) - r.Len()
+		fn(id, data[start:start+int(size)])
+		r.Seek(int64(size), io.SeekCurrent)
+	}
+	return nil
+}
+
+func readMatroskaInfo(r io.ReadSeeker) (*videoInfo, error) {
+	id, size, err := readEBMLHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if id != ebmlIDHeader || size == ebmlUnknownSize {
+		return nil, errUnsupportedVideo
+	}
+	if _, err = r.Seek(int64(size), io.SeekCurrent); err != nil {
+		return nil, err
+	}
+
+	if id, _, err = readEBMLHeader(r); err != nil {
+		return nil, err
+	}
+	if id != ebmlIDSegment {
+		return nil, errors.New("Matroska segment not found")
+	}
+
+	info := &videoInfo{}
+	var foundInfo, foundTracks bool
+	for !(foundInfo && foundTracks) {
+		id, size, err = readEBMLHeader(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if size == ebmlUnknownSize || id == ebmlIDCluster && foundInfo {
+			// clusters are usually after Info and Tracks
+			break
+		}
+
+		switch id {
+		case ebmlIDInfo, ebmlIDTracks:
+			if size > maxVideoHeaderSize {
+				return nil, fmt.Errorf("Matroska element too big: %d", size)
+			}
+			buf := make([]byte, size)
+			if _, err = io.ReadFull(r, buf); err != nil {
+				return nil, err
+			}
+			if id == ebmlIDInfo {
+				err = parseMatroskaInfo(buf, info)
+				foundInfo = true
+			} else {
+				err = parseMatroskaTracks(buf, info)
+				foundTracks = true
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if _, err = r.Seek(int64(size), io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !foundInfo {
+		return nil, errors.New("Matroska segment info not found")
+	}
+	return info, nil
+}
+
+func parseMatroskaInfo(data []byte, info *videoInfo) error {
+	var timecodeScale uint64 = 1000000
+	var duration float64
+	err := ebmlElements(data, func(id uint64, body []byte) {
+		switch id {
+		case ebmlIDTimecodeScale:
+			timecodeScale = ebmlUint(body)
+		case ebmlIDDuration:
+			duration = ebmlFloat(body)
+		case ebmlIDDateUTC:
+			if len(body) == 8 {
+				info.Created = matroskaEpoch.Add(time.Duration(int64(binary.BigEndian.Uint64(body))))
+			}
+		}
+	})
+	if duration > 0 {
+		info.Duration = time.Duration(duration * float64(timecodeScale))
+	}
+	return err
+}
+
+func parseMatroskaTracks(data []byte, info *videoInfo) error {
+	return ebmlElements(data, func(id uint64, body []byte) {
+		if id != ebmlIDTrackEntry || info.Width > 0 {
+			return
+		}
+		var trackType uint64
+		var w, h uint64
+		ebmlElements(body, func(id uint64, body []byte) {
+			switch id {
+			case ebmlIDTrackType:
+				trackType = ebmlUint(body)
+			case ebmlIDVideo:
+				ebmlElements(body, func(id uint64, body []byte) {
+					switch id {
+					case ebmlIDPixelWidth:
+						w = ebmlUint(body)
+					case ebmlIDPixelHeight:
+						h = ebmlUint(body)
+					}
+				})
+			}
+		})
+		if trackType == 1 {
+			info.Width, info.Height = int(w), int(h)
+		}
+	})
+}
+
+// ------------------------------------------------------------------------
+
+// videoValue returns the value of a {video:xxx} placeholder
+func videoValue(info *videoInfo, field string, layout string) (string, bool) {
+	switch field {
+	case "created":
+		if info.Created.IsZero() {
+			return "", false
+		}
+		if layout == "" {
+			layout = videoTimeLayout
+		}
+		return info.Created.Format(layout), true
+	case "duration":
+		if info.Duration <= 0 {
+			return "", false
+		}
+		return info.Duration.Round(time.Second).String(), true
+	case "width":
+		if info.Width <= 0 {
+			return "", false
+		}
+		return strconv.Itoa(info.Width), true
+	case "height":
+		if info.Height <= 0 {
+			return "", false
+		}
+		return strconv.Itoa(info.Height), true
+	}
+	return "", false
+}
+
+// replaceVideoPlaceholders fills {video:xxx} placeholders in the replacement
+func replaceVideoPlaceholders(opt *Options, path string, r string) (string, bool) {
+	info, err := readVideoInfo(path)
+	if err != nil && opt.Verbose == 0 && !opt.Quiet {
+		log.Warningf("  failed to read video metadata of %s: %s", path, err)
+	}
+
+	return replaceMetadata(opt, reVideo, r, func(m []string) (string, bool) {
+		if err != nil {
+			return "", false
+		}
+		layout := m[2]
+		if layout != "" {
+			layout = layout[1:]
+		}
+		return videoValue(info, m[1], layout)
+	})
+}
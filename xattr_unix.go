@@ -0,0 +1,71 @@
+// Copyright © 2013-2024 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux || darwin
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrs copies extended attributes. Attributes which can not be set,
+// e.g., those in namespaces needing privileges, are skipped.
+func copyXattrs(source string, target string) error {
+	size, err := unix.Llistxattr(source, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(source, buf)
+	if err != nil {
+		return nil
+	}
+
+	for _, name := range splitXattrNames(buf[:size]) {
+		n, err := unix.Lgetxattr(source, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, n)
+		if n, err = unix.Lgetxattr(source, name, value); err != nil {
+			continue
+		}
+		if err = unix.Lsetxattr(target, name, value[:n], 0); err != nil && err != unix.EPERM && err != unix.ENOTSUP {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitXattrNames splits the NUL-separated list of attribute names
+func splitXattrNames(buf []byte) []string {
+	names := make([]string, 0, 4)
+	var start int
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}